@@ -0,0 +1,157 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	
+	"xorm.io/core"
+)
+
+// 备份表名中只保留字母、数字和下划线
+var backupNameRegexp = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// BackupTableName 返回迁移执行前备份表的名称, 例如 person_backup_202307241038
+func BackupTableName(table, version string) string {
+	return fmt.Sprintf("%s_backup_%s", table, backupNameRegexp.ReplaceAllString(version, "_"))
+}
+
+// backupTables 在迁移执行前复制BackupTables中的表, 已存在的同名备份会被覆盖, 返回原表名到备份表名的映射
+// 备份只复制数据, 不包含索引和约束
+func (x *XorMigrate) backupTables(m *Migration) (map[string]string, error) {
+	backups := make(map[string]string, len(m.BackupTables))
+	for _, table := range m.BackupTables {
+		backup := BackupTableName(table, m.Version)
+		if err := x.dropTableIfExists(backup); err != nil {
+			return nil, err
+		}
+		query := fmt.Sprintf("CREATE TABLE %s AS SELECT * FROM %s", x.db.Quote(backup), x.db.Quote(table))
+		if x.db.Dialect().DBType() == core.MSSQL {
+			query = fmt.Sprintf("SELECT * INTO %s FROM %s", x.db.Quote(backup), x.db.Quote(table))
+		}
+		if _, err := x.tx.Exec(query); err != nil {
+			return nil, err
+		}
+		backups[table] = backup
+		logger.Infof("backed up table %s to %s before migration %s", table, backup, m.Version)
+	}
+	return backups, nil
+}
+
+// recordBackupTables 把备份表名保存到迁移记录的backup_tables列
+func (x *XorMigrate) recordBackupTables(version string, backups map[string]string) error {
+	if len(backups) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(backups)
+	if err != nil {
+		return err
+	}
+	_, err = x.tx.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), version).
+		Update(map[string]interface{}{"backup_tables": string(data)})
+	return err
+}
+
+// storedBackupTables 返回迁移记录中保存的备份表名, 没有记录时返回nil
+func (x *XorMigrate) storedBackupTables(version string) (map[string]string, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return nil, err
+	}
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Cols("backup_tables").
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), version).
+		Desc(x.recordOrder()...).
+		QueryString()
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		if row["backup_tables"] == "" {
+			continue
+		}
+		var backups map[string]string
+		if err := json.Unmarshal([]byte(row["backup_tables"]), &backups); err != nil {
+			return nil, err
+		}
+		return backups, nil
+	}
+	return nil, nil
+}
+
+// RestoreBackup 用备份表替换迁移version修改过的表, 只用于紧急恢复
+// 备份表名从迁移记录中读取, 没有记录时(例如迁移失败)按代码中的BackupTables推导
+// 原表会被删除, 备份表重命名为原表名, 不会修改迁移记录
+func (x *XorMigrate) RestoreBackup(version string) error {
+	backups, err := x.storedBackupTables(version)
+	if err != nil {
+		return err
+	}
+	if backups == nil {
+		migration := x.findMigration(version)
+		if migration == nil {
+			return &VersionNotFoundError{Version: version}
+		}
+		if len(migration.BackupTables) == 0 {
+			return ErrNoBackup
+		}
+		backups = make(map[string]string, len(migration.BackupTables))
+		for _, table := range migration.BackupTables {
+			backups[table] = BackupTableName(table, version)
+		}
+	}
+	tables := make([]string, 0, len(backups))
+	for table := range backups {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+	
+	if err := x.begin(context.Background()); err != nil {
+		return err
+	}
+	defer x.rollback()
+	
+	for _, table := range tables {
+		backup := backups[table]
+		exist, err := x.tx.IsTableExist(backup)
+		if err != nil {
+			return err
+		}
+		if !exist {
+			return fmt.Errorf("%w: %s", ErrNoBackup, backup)
+		}
+	}
+	for _, table := range tables {
+		if err := x.dropTableIfExists(table); err != nil {
+			return err
+		}
+		if _, err := x.tx.Exec(x.renameTableSQL(backups[table], table)); err != nil {
+			return err
+		}
+	}
+	return x.commit()
+}
+
+func (x *XorMigrate) dropTableIfExists(table string) error {
+	exist, err := x.tx.IsTableExist(table)
+	if err != nil || !exist {
+		return err
+	}
+	_, err = x.tx.Exec(fmt.Sprintf("DROP TABLE %s", x.db.Quote(table)))
+	return err
+}
+
+func (x *XorMigrate) renameTableSQL(from, to string) string {
+	switch x.db.Dialect().DBType() {
+	case core.MYSQL:
+		return fmt.Sprintf("RENAME TABLE %s TO %s", x.db.Quote(from), x.db.Quote(to))
+	case core.MSSQL:
+		return fmt.Sprintf("EXEC sp_rename '%s', '%s'", from, to)
+	}
+	return fmt.Sprintf("ALTER TABLE %s RENAME TO %s", x.db.Quote(from), x.db.Quote(to))
+}
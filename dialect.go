@@ -0,0 +1,283 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	
+	"xorm.io/core"
+)
+
+// 外键约束, 复合外键会拆成多个单列约束分别检查
+type foreignKey struct {
+	table            string
+	column           string
+	referencedTable  string
+	referencedColumn string
+}
+
+// checkForeignKeys 检查当前会话中是否存在违反外键约束的数据
+func (x *XorMigrate) checkForeignKeys() error {
+	var (
+		tables []string
+		err    error
+	)
+	switch x.db.Dialect().DBType() {
+	case core.SQLITE:
+		tables, err = x.sqliteForeignKeyViolations()
+	case core.MYSQL, core.POSTGRES:
+		tables, err = x.foreignKeyViolations()
+	default:
+		logger.Warnf("foreign key check is not supported by %s, skipped", x.db.Dialect().DBType())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(tables) > 0 {
+		return fmt.Errorf("%w: %s", ErrForeignKeyViolation, strings.Join(tables, ", "))
+	}
+	return nil
+}
+
+func (x *XorMigrate) sqliteForeignKeyViolations() ([]string, error) {
+	rows, err := x.tx.QueryString("PRAGMA foreign_key_check")
+	if err != nil {
+		return nil, err
+	}
+	tables := make(map[string]struct{})
+	for _, row := range rows {
+		tables[row["table"]] = struct{}{}
+	}
+	return sortedKeys(tables), nil
+}
+
+// foreignKeyViolations 通过information_schema读取外键, 逐个查询是否存在孤立的数据
+func (x *XorMigrate) foreignKeyViolations() ([]string, error) {
+	query := `SELECT TABLE_NAME AS table_name, COLUMN_NAME AS column_name,
+	REFERENCED_TABLE_NAME AS referenced_table_name, REFERENCED_COLUMN_NAME AS referenced_column_name
+FROM information_schema.KEY_COLUMN_USAGE
+WHERE TABLE_SCHEMA = DATABASE() AND REFERENCED_TABLE_NAME IS NOT NULL`
+	if x.db.Dialect().DBType() == core.POSTGRES {
+		query = `SELECT kcu.table_name, kcu.column_name,
+	ccu.table_name AS referenced_table_name, ccu.column_name AS referenced_column_name
+FROM information_schema.table_constraints tc
+JOIN information_schema.key_column_usage kcu
+	ON tc.constraint_name = kcu.constraint_name AND tc.table_schema = kcu.table_schema
+JOIN information_schema.constraint_column_usage ccu
+	ON tc.constraint_name = ccu.constraint_name AND tc.table_schema = ccu.table_schema
+WHERE tc.constraint_type = 'FOREIGN KEY' AND tc.table_schema = current_schema()`
+	}
+	rows, err := x.tx.QueryString(query)
+	if err != nil {
+		return nil, err
+	}
+	
+	tables := make(map[string]struct{})
+	for _, row := range rows {
+		fk := foreignKey{
+			table:            row["table_name"],
+			column:           row["column_name"],
+			referencedTable:  row["referenced_table_name"],
+			referencedColumn: row["referenced_column_name"],
+		}
+		if _, ok := tables[fk.table]; ok {
+			continue
+		}
+		orphans, err := x.tx.SQL(fmt.Sprintf(
+			"SELECT COUNT(*) FROM %s c LEFT JOIN %s p ON c.%s = p.%s WHERE c.%s IS NOT NULL AND p.%s IS NULL",
+			x.db.Quote(fk.table), x.db.Quote(fk.referencedTable),
+			x.db.Quote(fk.column), x.db.Quote(fk.referencedColumn),
+			x.db.Quote(fk.column), x.db.Quote(fk.referencedColumn),
+		)).Count()
+		if err != nil {
+			return nil, err
+		}
+		if orphans > 0 {
+			tables[fk.table] = struct{}{}
+		}
+	}
+	return sortedKeys(tables), nil
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// 迁移至少需要的权限
+var requiredPrivileges = []string{"CREATE", "ALTER", "INSERT", "UPDATE"}
+
+// mysqlGrantRegexp 匹配 GRANT SELECT, INSERT ON `db`.* TO `user`@`%`
+var mysqlGrantRegexp = regexp.MustCompile("^GRANT (.+?) ON (\\S+) TO ")
+
+// CheckPrivileges 检查当前数据库用户是否具有迁移需要的基本权限(CREATE、ALTER、INSERT、UPDATE)
+// 支持MySQL和PostgreSQL, 其他数据库直接通过
+func (x *XorMigrate) CheckPrivileges() error {
+	var (
+		missing []string
+		err     error
+	)
+	switch x.db.Dialect().DBType() {
+	case core.MYSQL:
+		missing, err = x.missingMySQLPrivileges()
+	case core.POSTGRES:
+		missing, err = x.missingPostgresPrivileges()
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingPrivileges, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (x *XorMigrate) missingMySQLPrivileges() ([]string, error) {
+	rows, err := x.db.QueryString("SHOW GRANTS")
+	if err != nil {
+		return nil, err
+	}
+	// 列名为 Grants for user@host, 每行只有一列
+	var grants []string
+	for _, row := range rows {
+		for _, grant := range row {
+			grants = append(grants, grant)
+		}
+	}
+	database, err := x.db.QueryString("SELECT DATABASE() AS db")
+	if err != nil {
+		return nil, err
+	}
+	var current string
+	if len(database) > 0 {
+		current = database[0]["db"]
+	}
+	return missingGrants(grants, current), nil
+}
+
+// missingGrants 解析SHOW GRANTS的结果, 返回在*.*和当前库上都没有授予的权限
+func missingGrants(grants []string, database string) []string {
+	granted := make(map[string]struct{})
+	for _, grant := range grants {
+		matches := mysqlGrantRegexp.FindStringSubmatch(grant)
+		if matches == nil {
+			continue
+		}
+		scope := strings.ReplaceAll(matches[2], "`", "")
+		if scope != "*.*" && scope != database+".*" {
+			continue
+		}
+		for _, privilege := range strings.Split(matches[1], ",") {
+			privilege = strings.ToUpper(strings.TrimSpace(privilege))
+			if privilege == "ALL" || privilege == "ALL PRIVILEGES" {
+				return nil
+			}
+			granted[privilege] = struct{}{}
+		}
+	}
+	
+	var missing []string
+	for _, privilege := range requiredPrivileges {
+		if _, ok := granted[privilege]; !ok {
+			missing = append(missing, privilege)
+		}
+	}
+	return missing
+}
+
+// PostgreSQL中ALTER需要表的所有权, 这里只检查schema的CREATE权限和迁移表的写权限
+func (x *XorMigrate) missingPostgresPrivileges() ([]string, error) {
+	var missing []string
+	rows, err := x.db.QueryString("SELECT has_schema_privilege(current_schema(), 'CREATE') AS granted")
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 || !isTrue(rows[0]["granted"]) {
+		missing = append(missing, "CREATE")
+	}
+	
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return missing, err
+	}
+	for _, privilege := range []string{"INSERT", "UPDATE"} {
+		rows, err := x.db.QueryString("SELECT has_table_privilege(?, ?) AS granted", x.options.TableName, privilege)
+		if err != nil {
+			return nil, err
+		}
+		if len(rows) == 0 || !isTrue(rows[0]["granted"]) {
+			missing = append(missing, privilege)
+		}
+	}
+	return missing, nil
+}
+
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "t", "true", "1":
+		return true
+	}
+	return false
+}
+
+// ddlStatementRegexp 匹配DDL语句, 允许语句前有注释
+var ddlStatementRegexp = regexp.MustCompile(`(?is)^\s*(?:(?:--[^\n]*(?:\n|$)|/\*.*?\*/)\s*)*(CREATE|ALTER|DROP|RENAME|TRUNCATE)\b`)
+
+// ddlStatements 返回迁移中的DDL语句
+// SQL文件迁移检查up文件中的语句, 其他迁移按";"拆分Content检查, 都没有时返回nil
+func (m *Migration) ddlStatements() []string {
+	statements := m.statements
+	if statements == nil && m.Content != "" {
+		statements = splitStatements(m.Content, DefaultSQLLoaderOptions)
+	}
+	var ddl []string
+	for _, statement := range statements {
+		if ddlStatementRegexp.MatchString(statement) {
+			ddl = append(ddl, statement)
+		}
+	}
+	return ddl
+}
+
+// checkSingleDDL 开启SingleDDLPerMigration时检查每个迁移最多包含一条DDL语句
+func (x *XorMigrate) checkSingleDDL() error {
+	if !x.options.SingleDDLPerMigration {
+		return nil
+	}
+	var invalid []string
+	for _, m := range x.migrations {
+		if n := len(m.ddlStatements()); n > 1 {
+			invalid = append(invalid, fmt.Sprintf("%s (%d statements)", m.Version, n))
+		}
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%w: %s", ErrMultipleDDL, strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+// warnMultipleDDL MySQL会隐式提交DDL, 迁移包含多条DDL时失败无法回滚已经执行的语句
+func (x *XorMigrate) warnMultipleDDL(m *Migration) {
+	if x.db.Dialect().DBType() != core.MYSQL {
+		return
+	}
+	if n := len(m.ddlStatements()); n > 1 {
+		logger.Warnf("migration %s contains %d DDL statements, MySQL commits each of them implicitly and a failure will not undo the ones already executed, consider one DDL statement per migration (see Options.SingleDDLPerMigration)", m.Version, n)
+	}
+}
+
+// warnImplicitCommit 迁移在MySQL上失败时提醒已经执行的DDL不会回滚
+func (x *XorMigrate) warnImplicitCommit(m *Migration) {
+	if x.db.Dialect().DBType() != core.MYSQL {
+		return
+	}
+	logger.Warnf("migration %s failed, DDL statements it executed before the error were committed implicitly by MySQL and are not rolled back, check the schema before retrying", m.Version)
+}
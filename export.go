@@ -0,0 +1,89 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+	
+	"xorm.io/core"
+)
+
+// ExportSQL 按运行顺序把迁移表中的迁移记录写成INSERT语句, 每行一条, 锁等xormigrate内部使用的记录不会导出
+// 生成的SQL可以直接在另一个数据库中执行, 需要先创建迁移表(例如运行一次没有待执行迁移的Migrate)
+func (x *XorMigrate) ExportSQL(w io.Writer) error {
+	table := x.db.TableInfo(x.model())
+	var columns, quoted []string
+	for _, col := range table.Columns() {
+		if col.IsAutoIncrement {
+			continue
+		}
+		columns = append(columns, col.Name)
+		quoted = append(quoted, x.db.Quote(col.Name))
+	}
+	
+	rows, err := x.db.Table(x.options.TableName).Cols(columns...).Asc(x.recordOrder()...).QueryInterface()
+	if err != nil {
+		return err
+	}
+	dbType := x.db.Dialect().DBType()
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES", x.db.Quote(x.options.TableName), strings.Join(quoted, ", "))
+	for _, row := range rows {
+		if isInternalVersion(sqlValueString(row[x.options.VersionColumnName])) {
+			continue
+		}
+		values := make([]string, 0, len(columns))
+		for _, name := range columns {
+			values = append(values, sqlLiteral(dbType, row[name], table.GetColumn(name).SQLType.IsNumeric()))
+		}
+		if _, err := fmt.Fprintf(w, "%s (%s);\n", prefix, strings.Join(values, ", ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sqlLiteral 把查询得到的值按数据库的规则写成SQL常量, NULL写成NULL, 时间使用数据库的datetime格式
+func sqlLiteral(dbType core.DbType, value interface{}, numeric bool) string {
+	switch v := value.(type) {
+	case nil:
+		return "NULL"
+	case time.Time:
+		return quoteSQLString(dbType, v.Format("2006-01-02 15:04:05"))
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	s := sqlValueString(value)
+	if numeric {
+		if _, err := strconv.ParseFloat(s, 64); err == nil {
+			return s
+		}
+	}
+	return quoteSQLString(dbType, s)
+}
+
+// sqlValueString 查询得到的值的文本形式
+func sqlValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// quoteSQLString 把s写成字符串常量, MySQL默认把反斜杠当作转义字符, 需要额外转义
+func quoteSQLString(dbType core.DbType, s string) string {
+	if dbType == core.MYSQL {
+		s = strings.ReplaceAll(s, `\`, `\\`)
+	}
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
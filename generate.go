@@ -0,0 +1,197 @@
+package migrate
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	
+	"github.com/go-xorm/xorm"
+	"xorm.io/core"
+)
+
+// GenerateNextMigration 对比数据库当前结构和models, 生成新增表、列和索引的迁移, Version为当前时间戳
+// 只生成新增操作, 数据库中多出的表和列不会生成删除语句, 只输出警告, 需要删除时请手写迁移
+func GenerateNextMigration(engine *xorm.Engine, models ...interface{}) (*Migration, error) {
+	tables, err := engine.DBMetas()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*core.Table, len(tables))
+	for _, table := range tables {
+		existing[strings.ToLower(table.Name)] = table
+	}
+	
+	var up, down, changes []string
+	for _, model := range models {
+		table := engine.TableInfo(model)
+		name := engine.TableName(model)
+		dbTable, ok := existing[strings.ToLower(name)]
+		if !ok {
+			up = append(up, createTableSQL(engine, table.Table, name)...)
+			down = append([]string{engine.Dialect().DropTableSql(name)}, down...)
+			changes = append(changes, "create table "+name)
+			continue
+		}
+		
+		for _, col := range table.Columns() {
+			if dbTable.GetColumn(col.Name) != nil {
+				continue
+			}
+			up = append(up, fmt.Sprintf("ALTER TABLE %s ADD %s", engine.Quote(name), col.String(engine.Dialect())))
+			down = append([]string{fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", engine.Quote(name), engine.Quote(col.Name))}, down...)
+			changes = append(changes, fmt.Sprintf("add column %s.%s", name, col.Name))
+		}
+		for _, col := range dbTable.Columns() {
+			if table.GetColumn(col.Name) == nil {
+				logger.Warnf("column %s.%s is not in the model, drop it in a hand-written migration if needed", name, col.Name)
+			}
+		}
+		for _, indexName := range sortedIndexNames(table.Indexes) {
+			if _, ok := dbTable.Indexes[indexName]; ok {
+				continue
+			}
+			index := table.Indexes[indexName]
+			up = append(up, engine.Dialect().CreateIndexSql(name, index))
+			down = append([]string{engine.Dialect().DropIndexSql(name, index)}, down...)
+			changes = append(changes, fmt.Sprintf("add index %s.%s", name, indexName))
+		}
+	}
+	if len(up) == 0 {
+		return nil, ErrNoSchemaChanges
+	}
+	
+	return &Migration{
+		Version:     GenVersion(),
+		Description: strings.Join(changes, ", "),
+		Migrate:     execSQL(up),
+		Rollback:    execSQL(down),
+	}, nil
+}
+
+// 建表语句和表上的索引
+func createTableSQL(engine *xorm.Engine, table *core.Table, name string) []string {
+	statements := []string{engine.Dialect().CreateTableSql(table, name, table.StoreEngine, table.Charset)}
+	for _, indexName := range sortedIndexNames(table.Indexes) {
+		statements = append(statements, engine.Dialect().CreateIndexSql(name, table.Indexes[indexName]))
+	}
+	return statements
+}
+
+func sortedIndexNames(indexes map[string]*core.Index) []string {
+	names := make([]string, 0, len(indexes))
+	for name := range indexes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// VerifyInitMatchesMigrations 分别用InitSchema和逐个运行迁移建立两个数据库, 对比两者的表和列
+// 不一致时返回ErrSchemaDrift并列出差异, 用于在CI中发现InitSchema与迁移不同步
+// engineFactory每次调用需要返回一个新的空数据库, 使用完后会被关闭
+func (x *XorMigrate) VerifyInitMatchesMigrations(engineFactory func() (*xorm.Engine, error)) error {
+	if !x.hasInitSchema() {
+		return ErrNoInitSchema
+	}
+	options := x.Config()
+	// 验证用的数据库是临时的, 不通知调用方
+	options.OnCommit = nil
+	
+	build := func(withInitSchema bool) (map[string]map[string]string, error) {
+		engine, err := engineFactory()
+		if err != nil {
+			return nil, err
+		}
+		defer engine.Close()
+		opts := options
+		migrator := New(engine, &opts, x.migrations)
+		if withInitSchema {
+			migrator.initSchema = x.initSchema
+		} else {
+			migrator.options.InitSchemaSQL = nil
+		}
+		if err := migrator.Migrate(); err != nil {
+			return nil, err
+		}
+		return schemaColumns(engine, options.TableName)
+	}
+	initSchema, err := build(true)
+	if err != nil {
+		return fmt.Errorf("xormigrate: init schema: %w", err)
+	}
+	migrated, err := build(false)
+	if err != nil {
+		return fmt.Errorf("xormigrate: migrations: %w", err)
+	}
+	
+	if diff := diffSchemas(initSchema, migrated); len(diff) > 0 {
+		return fmt.Errorf("%w: %s", ErrSchemaDrift, strings.Join(diff, "; "))
+	}
+	return nil
+}
+
+// schemaColumns 返回除迁移表以外所有表的列和类型
+func schemaColumns(engine *xorm.Engine, migrationTable string) (map[string]map[string]string, error) {
+	tables, err := engine.DBMetas()
+	if err != nil {
+		return nil, err
+	}
+	schema := make(map[string]map[string]string, len(tables))
+	for _, table := range tables {
+		if table.Name == migrationTable {
+			continue
+		}
+		columns := make(map[string]string, len(table.Columns()))
+		for _, col := range table.Columns() {
+			columns[col.Name] = col.SQLType.Name
+		}
+		schema[table.Name] = columns
+	}
+	return schema, nil
+}
+
+// diffSchemas 返回initSchema和migrated之间的差异, 按表名和列名排序
+func diffSchemas(initSchema, migrated map[string]map[string]string) []string {
+	var diff []string
+	for _, table := range unionKeys(initSchema, migrated) {
+		initColumns, inInit := initSchema[table]
+		migratedColumns, inMigrated := migrated[table]
+		switch {
+		case !inMigrated:
+			diff = append(diff, fmt.Sprintf("table %s only in init schema", table))
+			continue
+		case !inInit:
+			diff = append(diff, fmt.Sprintf("table %s only in migrations", table))
+			continue
+		}
+		for _, column := range unionKeys(initColumns, migratedColumns) {
+			initType, inInit := initColumns[column]
+			migratedType, inMigrated := migratedColumns[column]
+			switch {
+			case !inMigrated:
+				diff = append(diff, fmt.Sprintf("column %s.%s only in init schema", table, column))
+			case !inInit:
+				diff = append(diff, fmt.Sprintf("column %s.%s only in migrations", table, column))
+			case initType != migratedType:
+				diff = append(diff, fmt.Sprintf("column %s.%s is %s in init schema but %s in migrations", table, column, initType, migratedType))
+			}
+		}
+	}
+	return diff
+}
+
+// unionKeys 返回所有map的键的并集, 按字典序排序
+func unionKeys[V any](maps ...map[string]V) []string {
+	seen := make(map[string]struct{})
+	var keys []string
+	for _, m := range maps {
+		for key := range m {
+			if _, ok := seen[key]; !ok {
+				seen[key] = struct{}{}
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
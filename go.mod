@@ -5,9 +5,10 @@ go 1.18
 require (
 	github.com/go-sql-driver/mysql v1.7.1
 	github.com/go-xorm/xorm v0.7.9
+	github.com/mattn/go-sqlite3 v1.14.17
+	xorm.io/core v0.7.2-0.20190928055935-90aeac8d08eb
 )
 
 require (
 	xorm.io/builder v0.3.6 // indirect
-	xorm.io/core v0.7.2-0.20190928055935-90aeac8d08eb // indirect
 )
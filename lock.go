@@ -0,0 +1,192 @@
+package migrate
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	
+	"github.com/go-xorm/xorm"
+	"xorm.io/core"
+)
+
+// ensureLockRow 在事务外创建迁移表和加锁用的记录
+// 避免并发的首次运行在各自的事务中插入同一条记录而冲突
+func (x *XorMigrate) ensureLockRow() error {
+	x.tx = x.db.NewSession()
+	defer x.tx.Close()
+	
+	if err := x.createMigrationTableIfNotExists(); err != nil {
+		return err
+	}
+	exist, err := x.lockRowExists()
+	if err != nil || exist {
+		return err
+	}
+	if err := x.insertMigration(lockMigrationVersion); err != nil {
+		// 可能已被并发运行的迁移器插入
+		if exist, _ := x.lockRowExists(); exist {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (x *XorMigrate) lockRowExists() (bool, error) {
+	count, err := x.tx.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), lockMigrationVersion).
+		Count()
+	return count > 0, err
+}
+
+// lockMigrationsTable 对加锁用的记录加锁, 直到事务提交或回滚
+func (x *XorMigrate) lockMigrationsTable() error {
+	cond := fmt.Sprintf("%s = ?", x.options.VersionColumnName)
+	if x.db.Dialect().DBType() == core.SQLITE {
+		// SQLite不支持FOR UPDATE, 通过写入获取数据库的写锁
+		_, err := x.tx.Table(x.options.TableName).Where(cond, lockMigrationVersion).Update(map[string]interface{}{x.options.RollbackColumnName: 0})
+		return err
+	}
+	_, err := x.tx.Table(x.options.TableName).Where(cond, lockMigrationVersion).ForUpdate().QueryString()
+	return err
+}
+
+func newClaimToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// runClaimedMigration 声明迁移后运行, 运行迁移函数时不持有锁
+// 声明和完成后的记录分别在独立的短事务中执行
+func (x *XorMigrate) runClaimedMigration(ctx context.Context, m *Migration) error {
+	claimed, err := x.claimMigration(m)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		logger.Infof("migration %s is claimed by another run, skipped", m.Version)
+		return nil
+	}
+	
+	// 检查和声明之间迁移可能已经被其他运行完成
+	migrationRan, err := x.migrationRan(m)
+	if err == nil && !migrationRan && m.MigrateTx != nil {
+		// 迁移函数和完成记录在同一个事务中
+		if err = x.completeClaimedMigration(m, func() error {
+			return x.executeAndRecord(ctx, m)
+		}); err == nil {
+			return nil
+		}
+	} else if err == nil && !migrationRan {
+		var record func() error
+		if record, err = x.executeMigration(ctx, m); err == nil {
+			return x.completeClaimedMigration(m, record)
+		}
+	}
+	
+	session := x.db.NewSession()
+	defer session.Close()
+	if _, releaseErr := x.releaseClaim(session, m); releaseErr != nil {
+		logger.Errorf("failed to release claim of migration %s: %v", m.Version, releaseErr)
+	}
+	return err
+}
+
+// completeClaimedMigration 在一个事务中删除声明记录并记录迁移, 声明已不属于本次运行时返回ErrClaimLost
+func (x *XorMigrate) completeClaimedMigration(m *Migration, record func() error) error {
+	return x.withTransaction(func(session *xorm.Session) error {
+		released, err := x.releaseClaim(session, m)
+		if err != nil {
+			return err
+		}
+		if !released {
+			return fmt.Errorf("%w: %s", ErrClaimLost, m.Version)
+		}
+		return record()
+	})
+}
+
+// claimMigration 插入声明记录, 已被其他运行声明时返回false
+func (x *XorMigrate) claimMigration(m *Migration) (bool, error) {
+	_, err := x.db.Table(x.options.TableName).Insert(map[string]interface{}{
+		x.options.VersionColumnName: claimMigrationPrefix + m.Version,
+		"claimed_by":                x.claimToken,
+	})
+	if err == nil {
+		return true, nil
+	}
+	count, countErr := x.db.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), claimMigrationPrefix+m.Version).
+		Count()
+	if countErr == nil && count > 0 {
+		return false, nil
+	}
+	return false, err
+}
+
+// releaseClaim 删除本次运行的声明记录, 声明已不属于本次运行时返回false
+func (x *XorMigrate) releaseClaim(session *xorm.Session, m *Migration) (bool, error) {
+	affected, err := session.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = ? AND claimed_by = ?", x.options.VersionColumnName), claimMigrationPrefix+m.Version, x.claimToken).
+		Delete(x.model())
+	return affected > 0, err
+}
+
+// advisoryLockName 返回开启UseLock时使用的锁名, 同一个库中不同迁移表的迁移互不影响
+func (x *XorMigrate) advisoryLockName() string {
+	return "xormigrate:" + x.options.TableName
+}
+
+// acquireAdvisoryLock 获取数据库的咨询锁, 返回释放锁的函数
+// 咨询锁属于连接, 因此使用单独的连接一直持有到释放, 不支持的数据库只输出警告
+func (x *XorMigrate) acquireAdvisoryLock(ctx context.Context) (func(), error) {
+	var (
+		lockQuery, unlockQuery string
+		key                    interface{}
+	)
+	switch x.db.Dialect().DBType() {
+	case core.MYSQL:
+		// 超时为负数时一直等待, 成功返回1
+		lockQuery, unlockQuery = "SELECT GET_LOCK(?, -1)", "SELECT RELEASE_LOCK(?)"
+		key = x.advisoryLockName()
+	case core.POSTGRES:
+		lockQuery, unlockQuery = "SELECT 1 FROM (SELECT pg_advisory_lock($1)) AS l", "SELECT pg_advisory_unlock($1)"
+		h := fnv.New64a()
+		h.Write([]byte(x.advisoryLockName()))
+		key = int64(h.Sum64())
+	default:
+		logger.Warnf("advisory lock is not supported by %s, running without lock", x.db.Dialect().DBType())
+		return func() {}, nil
+	}
+	
+	conn, err := x.db.DB().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, lockQuery, key).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if locked.Int64 != 1 {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrLockNotAcquired, x.advisoryLockName())
+	}
+	logger.Debugf("acquired advisory lock %s", x.advisoryLockName())
+	
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), unlockQuery, key); err != nil {
+			logger.Errorf("failed to release advisory lock %s: %v", x.advisoryLockName(), err)
+		}
+		conn.Close()
+	}, nil
+}
@@ -1,17 +1,56 @@
 package migrate
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 	
 	"github.com/go-xorm/xorm"
+	"xorm.io/core"
 )
 
 const (
 	// 保留Version 只有在初始化时使用
 	initSchemaMigrationVersion = "SCHEMA_INIT"
+	// 使用InitSchemaSQL初始化时记录进度的临时记录, 例如 SCHEMA_INIT_PROGRESS:12
+	initSchemaProgressPrefix = "SCHEMA_INIT_PROGRESS:"
+	// 开启OptimisticLocking时表示迁移正在运行的声明记录, 例如 MIGRATION_CLAIM:202307241038
+	claimMigrationPrefix = "MIGRATION_CLAIM:"
+	// 开启LockMigrationsTable时用于加锁的记录
+	lockMigrationVersion = "MIGRATIONS_LOCK"
+	// 迁移表description列的长度, 更长的描述会被截断
+	descriptionColumnSize = 255
+	// 迁移表rollback_reason列的长度, 更长的原因会被截断
+	rollbackReasonColumnSize = 255
+)
+
+// CurrentOperation 返回的迁移阶段
+const (
+	// OperationIdle 没有正在运行的迁移
+	OperationIdle = ""
+	// OperationValidating 校验迁移定义
+	OperationValidating = "validating"
+	// OperationLocking 锁定迁移表
+	OperationLocking = "locking"
+	// OperationInitSchema 运行InitSchema
+	OperationInitSchema = "initializing schema"
+	// OperationMigrating 运行迁移, 同时返回迁移的version
+	OperationMigrating = "migrating"
+	// OperationCommitting 提交迁移记录
+	OperationCommitting = "committing"
 )
 
 type MigrateFunc func(engine *xorm.Engine) error
@@ -20,6 +59,18 @@ type RollbackFunc func(engine *xorm.Engine) error
 
 type InitSchemaFunc func(engine *xorm.Engine) error
 
+// MigrateFuncMulti 可以同时操作多个数据库的迁移函数, engines为NewMulti中注册的数据库
+type MigrateFuncMulti func(engines map[string]*xorm.Engine) error
+
+// MigrateFuncTx 在迁移记录所在的事务中运行的迁移函数, 修改和迁移记录一起提交或回滚
+type MigrateFuncTx func(tx *xorm.Session) error
+
+// RollbackFuncTx 在迁移记录所在的事务中运行的回滚函数, 修改和回滚标记一起提交或回滚
+type RollbackFuncTx func(tx *xorm.Session) error
+
+// MigrateFuncCtx 可以读取运行时context的迁移函数, ctx带有WithValue设置的值和Migration.Timeout的期限
+type MigrateFuncCtx func(ctx context.Context, engine *xorm.Engine) error
+
 // Options define options for all migrations.
 type Options struct {
 	// TableName 默认migrations
@@ -28,12 +79,238 @@ type Options struct {
 	VersionColumnName string
 	// VersionColumnSize
 	VersionColumnSize int64
-	// UseTransaction
-	//UseTransaction bool
+	// RollbackColumnName 标记迁移已回滚的列名, 默认"is_rollback"
+	RollbackColumnName string
+	// IDColumnName 自增主键的列名, 默认"id"
+	IDColumnName string
+	// VersionAsPrimaryKey 迁移表不使用自增主键, 以version列作为主键, 记录按运行时间和version排序
+	// 只在建表时生效, 已经存在的迁移表不会被修改
+	VersionAsPrimaryKey bool
+	// SuffixSeparator version中时间戳与后缀(例如表名)的分隔符, 默认"_"
+	// 排序时先比较时间戳, 时间戳相同时再比较后缀
+	SuffixSeparator string
+	// UseTransaction 每个迁移的记录(包括影响行数和回滚语句)在单独的事务中写入并提交, 回滚时标记记录同样如此
+	// Migrate和Rollback函数接收的是*xorm.Engine, 其中的语句不在该事务中; MySQL的DDL本身也会隐式提交, 无法回滚
+	// 关闭时不使用事务, 每条记录语句单独生效; 开启LockMigrationsTable时记录已经在整个运行的事务中, 该选项不再单独开启事务
+	UseTransaction bool
 	// 如果数据库中有未知的迁移version, ValidateUnknownMigrations将导致迁移失败
 	ValidateUnknownMigrations bool
+	// UnknownMigrationStrategy 开启ValidateUnknownMigrations时如何处理未知的迁移, 默认UnknownMigrationFail
+	UnknownMigrationStrategy UnknownMigrationStrategy
+	// ConfirmRemoveUnknownMigrations 确认使用UnknownMigrationRemove删除未知迁移的记录
+	ConfirmRemoveUnknownMigrations bool
+	// TrustInitSchemaMarkers 数据库通过InitSchema初始化过时, 小于代码中第一个迁移version的记录不视为未知迁移
+	// 用于合并旧迁移后, InitSchema当时记录的旧迁移不再触发ValidateUnknownMigrations
+	TrustInitSchemaMarkers bool
+	// InitSchemaSQL 代替InitSchema函数, 按顺序逐条执行的初始化语句
+	// 每执行完一条都会记录进度, 初始化中途失败后再次运行会从上次完成的语句之后继续
+	InitSchemaSQL []string
+	// InitSchemaTables InitSchema(或InitSchemaSQL)创建的表, 迁移表为空但其中有表已经存在时不运行InitSchema,
+	// 返回ErrInitSchemaTablesExist, 避免给已有表的项目添加InitSchema后重复建表
+	InitSchemaTables []string
+	// InitSchemaProgress 每执行完一条InitSchemaSQL语句后调用
+	InitSchemaProgress func(done, total int)
 	// 启用硬删除, 默认软删除
 	HardDelete bool
+	// SessionTimezone 迁移会话开始时设置的时区, 例如"UTC"、"Asia/Shanghai"、"+08:00"
+	// 设置后每次运行使用单独的连接池, 其中每个连接都设置了该时区, 迁移表和Migrate、MigrateCtx、MigrateTx都使用这些连接
+	// 不影响应用使用的连接, MigrateMulti中的其他数据库不受影响, 支持MySQL和PostgreSQL, 为空时使用数据库默认时区
+	SessionTimezone string
+	// CheckForeignKeys 检查外键约束, 存在违反约束的数据时迁移失败, 支持SQLite、MySQL和PostgreSQL
+	// 开启LockMigrationsTable时在提交前检查一次, 失败时整个运行回滚
+	// 否则迁移记录写入即生效, 在每个迁移运行后、写入记录前检查, 失败的迁移不会被记录为已运行
+	CheckForeignKeys bool
+	// AutoBackup 执行迁移前备份Migration.BackupTables中的表, 备份表名记录在迁移记录中, 可以通过RestoreBackup恢复
+	AutoBackup bool
+	// CheckPrivilegesFirst 迁移前先调用CheckPrivileges检查数据库用户权限
+	CheckPrivilegesFirst bool
+	// CaptureSource New时记录每个迁移函数定义的位置(file:line), 迁移失败时输出到错误和日志中
+	CaptureSource bool
+	// OnChecksumMismatch 数据库中记录的校验值(包括已回滚的记录)与代码中的Checksum不一致时调用, 决定如何处理
+	// 为nil时返回ErrChecksumMismatch
+	OnChecksumMismatch func(version, dbChecksum, codeChecksum string) (ChecksumAction, error)
+	// DryRun Migrate只输出将要运行的迁移和Description, 不运行迁移函数, 也不写入迁移表
+	DryRun bool
+	// ValidateOrder 要求迁移按version严格递增排列, 否则Migrate返回ErrMigrationsOutOfOrder
+	ValidateOrder bool
+	// AutoSort New时按version排序迁移, 比较方式同SQL文件排序, 见SuffixSeparator
+	// 不开启时按传入的顺序运行, 调用方自行保证顺序
+	AutoSort bool
+	// VersionLess 比较两个version的先后, 用于AutoSort、ValidateOrder、RollbackFloor和TrustInitSchemaMarkers
+	// 例如使用语义化版本(1.2.10)时传入semver比较函数
+	// 为nil时同SQL文件排序: 先按数值比较Options.SuffixSeparator之前的部分, 再比较后缀
+	VersionLess func(a, b string) bool
+	// RequireDescription 要求所有迁移都填写Description, 否则Migrate返回ErrMissingDescription
+	RequireDescription bool
+	// SkipChecksumValidation Migrate时不比较已运行迁移的校验值
+	SkipChecksumValidation bool
+	// RecordAffectedRows 对比迁移前后Migration.AffectedTables的行数, 记录到affected_rows列
+	// 只能统计插入和删除的行, 更新不会改变行数
+	RecordAffectedRows bool
+	// MaxPendingWarn 本次运行需要执行的迁移超过该数量时输出警告, 0为不检查
+	MaxPendingWarn int
+	// MaxPendingFail 超过MaxPendingWarn时不运行任何迁移, 返回ErrTooManyPending
+	MaxPendingFail bool
+	// InterMigrationDelay 一次运行中两个迁移之间的等待时间, 给从库追上复制的时间, 0为不等待
+	InterMigrationDelay time.Duration
+	// MigrationTimeout 每个迁移函数的最长运行时间, 超时返回ErrMigrationTimeout, Migration.Timeout不为0时优先使用, 0为不限制
+	// 超时只能中断MigrateCtx(通过ctx)和MigrateTx(通过事务)中的查询, Migrate和MigrateMulti会在后台继续运行直到返回
+	MigrationTimeout time.Duration
+	// TableExistsFunc 判断迁移表是否存在, 用于默认检测不可靠的数据库驱动
+	// 为nil时使用xorm的IsTableExist和Sync2
+	TableExistsFunc func(engine *xorm.Engine, table string) (bool, error)
+	// SnapshotSchema 每个迁移运行后记录表结构的指纹(表和列的sha256), 可以通过SchemaAt查询
+	// 设置了Migration.AffectedTables时只包括这些表, 否则包括迁移表以外的所有表
+	SnapshotSchema bool
+	// WaitForTable 建表后轮询直到迁移表可见, 最多等待该时间, 用于新建的表不会立即对其他连接可见的集群数据库
+	// 0为不等待
+	WaitForTable time.Duration
+	// LockMigrationsTable 运行开始时在事务中对迁移表的一条专用记录加锁(SELECT ... FOR UPDATE), 并发的运行会依次执行
+	// 等待锁的时间受数据库锁超时设置限制(MySQL的innodb_lock_wait_timeout、PostgreSQL的lock_timeout)
+	// 迁移函数使用独立的连接, 不要在迁移函数中修改迁移表, 否则会与自己持有的锁死锁
+	// SQLite不支持行锁, 会锁住整个数据库, 迁移函数中的写操作同样会死锁
+	LockMigrationsTable bool
+	// UseLock 运行迁移期间持有数据库的咨询锁(MySQL的GET_LOCK、PostgreSQL的pg_advisory_lock), 同时启动的实例依次运行
+	// 与LockMigrationsTable不同, 锁不在迁移表的事务中, 迁移函数可以正常读写数据库; 其他数据库不支持, 只输出警告
+	UseLock bool
+	// StoreRollbackSQL 运行迁移时把Migration.RollbackSQL保存到rollback_sql列, 之后可以通过RollbackStored回滚
+	StoreRollbackSQL bool
+	// OptimisticLocking 不在整个运行期间加锁, 运行每个迁移前插入一条声明记录(依靠version的唯一索引保证只有一个运行能声明成功),
+	// 迁移函数运行时不持有任何锁, 完成后在一个短事务中确认声明仍属于自己并记录迁移
+	// 已被其他运行声明的迁移会被跳过, 并发运行会同时执行不同的迁移, 因此迁移之间不能有依赖
+	// 运行中断留下的声明记录(MIGRATION_CLAIM:<version>)需要手动删除, 不要与LockMigrationsTable同时开启
+	OptimisticLocking bool
+	// OnCommit Migrate提交成功后调用, 参数为本次运行的迁移(通过InitSchema初始化时为所有迁移), 没有运行任何迁移时不调用
+	// 返回的错误会作为Migrate的结果返回, 但此时迁移已经提交, 不会回滚
+	OnCommit func(appliedVersions []string) error
+	// OnSkip 迁移已经运行过, 本次运行跳过时调用, 例如在CI中输出已运行的迁移
+	// 与SkipIf跳过的迁移无关, 那些迁移会记录为已运行
+	OnSkip func(version string)
+	// RecordRunPlan 运行迁移前把将要执行的迁移写入执行计划表, 成功后清除
+	// 用于在不支持DDL事务的数据库(例如MySQL)上, 进程崩溃后了解上一次运行中断的位置, 见StaleRunPlan
+	RecordRunPlan bool
+	// RunPlanTableName 执行计划表名, 默认为迁移表名加"_run_plan"
+	RunPlanTableName string
+	// OnStaleRunPlan 开启RecordRunPlan时发现上一次运行没有完成时调用, 返回错误时不运行迁移, 为nil时输出警告
+	OnStaleRunPlan func(plan *StaleRunPlan) error
+	// DefaultRollbackReason 回滚时记录到rollback_reason列的原因, 可以通过RollbackLastReason等方法为单次回滚指定
+	DefaultRollbackReason string
+	// RollbackFloor 拒绝回滚Version小于等于该值的迁移, 返回ErrRollbackFloorReached, 用于保护基线等基础迁移
+	// 为空时不限制
+	RollbackFloor string
+	// VerifyAfterCommitError Migrate提交失败时重新查询数据库, 返回*CommitError说明迁移记录是否实际已经写入
+	// 只在开启LockMigrationsTable时有效, 否则迁移记录逐条自动提交, 没有需要确认的提交
+	VerifyAfterCommitError bool
+	// OnTableCreated 迁移表被创建后调用, 表已经存在时不会调用, 返回错误会中止本次运行
+	// 可以用于给迁移表授权或者添加触发器
+	OnTableCreated func(engine *xorm.Engine, table string) error
+	// VersionGenerator NextVersion使用的version生成方式, 默认TimestampVersionGenerator
+	VersionGenerator VersionGenerator
+	// SingleDDLPerMigration 运行前检查每个迁移最多包含一条DDL语句, 否则返回ErrMultipleDDL
+	// MySQL会隐式提交DDL, 迁移失败时已经执行的DDL不会回滚, 每个迁移只有一条DDL时失败的迁移不会留下部分修改
+	// 只能检查SQL文件迁移和设置了Content的迁移
+	SingleDDLPerMigration bool
+	// BeforeMigrate 确保迁移表存在后、运行迁移(或InitSchema)前调用, 参数为迁移表所在的会话
+	// 开启LockMigrationsTable时该会话是本次运行的事务, 返回错误会中止本次运行并回滚
+	BeforeMigrate func(session *xorm.Session) error
+	// AfterMigrate 所有迁移运行后、提交前调用, 参数同BeforeMigrate, 返回错误时Migrate返回该错误
+	// 开启LockMigrationsTable时本次运行的迁移记录会回滚, 否则迁移记录已经逐条提交, 不会回滚
+	// 例如在BeforeMigrate中关闭外键检查, 在AfterMigrate中重新开启
+	AfterMigrate func(session *xorm.Session) error
+	// RecoverPanics 迁移函数panic时恢复, 中止本次运行并返回ErrMigrationPanicked, 不开启时panic会继续向上传递
+	// 开启LockMigrationsTable时本次运行的迁移记录会回滚, 否则panic之前的迁移记录已经提交
+	RecoverPanics bool
+}
+
+// UnknownMigrationStrategy 处理数据库中存在但是代码中不存在的迁移的方式
+type UnknownMigrationStrategy int
+
+const (
+	// UnknownMigrationFail 迁移失败, 返回ErrUnknownPastMigration
+	UnknownMigrationFail UnknownMigrationStrategy = iota
+	// UnknownMigrationWarn 记录警告日志后继续迁移
+	UnknownMigrationWarn
+	// UnknownMigrationRemove 删除未知迁移的记录后继续迁移, 需要同时开启ConfirmRemoveUnknownMigrations
+	UnknownMigrationRemove
+	// UnknownMigrationTreatAsApplied 视为已运行的迁移, 已经回滚的未知迁移重新记录为已运行, 之后不再报告这些记录
+	UnknownMigrationTreatAsApplied
+)
+
+// ChecksumAction 校验值不一致时的处理方式
+type ChecksumAction int
+
+const (
+	// ChecksumFail 迁移失败, 返回ErrChecksumMismatch
+	ChecksumFail ChecksumAction = iota
+	// ChecksumIgnore 忽略不一致, 按正常流程继续迁移
+	ChecksumIgnore
+	// ChecksumReapplyForce 重新运行该迁移(即使已经运行过)并记录新的校验值
+	ChecksumReapplyForce
+)
+
+// CancelledError ctx取消导致迁移中途停止
+type CancelledError struct {
+	// Completed 取消前本次运行已经完成并且记录已经保存的迁移
+	// 开启LockMigrationsTable时取消会回滚整个事务, 没有迁移被保存, Completed为空
+	Completed []string
+	// Interrupted 取消时正在运行的迁移, 在两个迁移之间取消时为空
+	Interrupted string
+	// Err ctx.Err()
+	Err error
+}
+
+func (e *CancelledError) Error() string {
+	if e.Interrupted != "" {
+		return fmt.Sprintf("xormigrate: Migration cancelled while running %s after %d completed: %v", e.Interrupted, len(e.Completed), e.Err)
+	}
+	return fmt.Sprintf("xormigrate: Migration cancelled after %d completed: %v", len(e.Completed), e.Err)
+}
+
+func (e *CancelledError) Unwrap() error {
+	return e.Err
+}
+
+// MigrateResult MigrateWithResult的运行结果
+type MigrateResult struct {
+	// Applied 本次运行的迁移version, 按运行顺序, 通过InitSchema初始化时为所有迁移
+	Applied []string
+	// Skipped 本次通过SkipIf或ErrSkipMigration跳过(记录为已运行)的迁移version
+	Skipped []string
+	// Durations 本次运行(包括跳过)的每个迁移所用的时间
+	Durations map[string]time.Duration
+	// Duration 本次运行的总时间
+	Duration time.Duration
+}
+
+// CommitError 开启VerifyAfterCommitError时Migrate提交失败返回, 说明迁移记录是否实际写入了数据库
+type CommitError struct {
+	// Versions 本次提交的迁移
+	Versions []string
+	// Verified 是否查询到了数据库中的实际状态, 为false时Persisted和Missing没有意义
+	Verified bool
+	// Persisted Versions都已经写入数据库, 不需要重试
+	Persisted bool
+	// Missing 没有写入数据库的迁移
+	Missing []string
+	// VerifyErr 查询实际状态时的错误
+	VerifyErr error
+	// Err 提交时的错误
+	Err error
+}
+
+func (e *CommitError) Error() string {
+	switch {
+	case !e.Verified:
+		return fmt.Sprintf("xormigrate: Commit failed and the applied state could not be verified (%v): %v", e.VerifyErr, e.Err)
+	case e.Persisted:
+		return fmt.Sprintf("xormigrate: Commit failed but all %d migrations were persisted, do not retry: %v", len(e.Versions), e.Err)
+	default:
+		return fmt.Sprintf("xormigrate: Commit failed and %d of %d migrations were not persisted, retry is needed: %v", len(e.Missing), len(e.Versions), e.Err)
+	}
+}
+
+func (e *CommitError) Unwrap() error {
+	return e.Err
 }
 
 // Migration 数据库迁移操作
@@ -43,19 +320,88 @@ type Migration struct {
 	Version string
 	// Migrate 迁移函数
 	Migrate MigrateFunc
+	// MigrateMulti 跨数据库的迁移函数, 设置后代替Migrate运行, 只能用于NewMulti创建的XorMigrate
+	// 各数据库的修改不在同一个事务中, 失败时已经完成的修改不会被撤销
+	MigrateMulti MigrateFuncMulti
+	// MigrateCtx 需要运行时参数时代替Migrate使用, 参数通过XorMigrate.WithValue设置
+	MigrateCtx MigrateFuncCtx
+	// MigrateTx 设置时代替Migrate使用, 修改和迁移记录在同一个事务中提交
+	// MySQL等数据库的DDL会隐式提交事务, 只有DML能保证和迁移记录一起回滚
+	MigrateTx MigrateFuncTx
 	// Rollback 回滚函数 可为nil
 	Rollback RollbackFunc
+	// RollbackTx 设置时代替Rollback使用, 修改和回滚标记在同一个事务中提交, 同MigrateTx只有DML能保证原子性
+	RollbackTx RollbackFuncTx
 	// Description 对此次迁移进行描述
 	Description string
+	// RequiresDowntime 标记此次迁移需要停机执行, 仅作为发布计划的参考, 不影响执行
+	RequiresDowntime bool
+	// Tags 迁移的标签, 例如所属的服务, MigrateByTag只运行带有指定标签的迁移
+	Tags []string
+	// SkipIf 运行前调用, 返回true时不运行Migrate, 迁移记录为已运行并保存跳过的原因
+	SkipIf func(engine *xorm.Engine) (skip bool, reason string)
+	// BackupTables 开启Options.AutoBackup时, 执行迁移前备份这些表
+	BackupTables []string
+	// AffectedTables 开启Options.RecordAffectedRows时, 统计这些表在迁移前后的行数变化
+	AffectedTables []string
+	// RollbackSQL 回滚语句, SQL文件迁移由加载器根据down文件设置, 开启Options.StoreRollbackSQL时保存到数据库
+	RollbackSQL []string
+	// Timeout 迁移函数的最长运行时间, 0时使用Options.MigrationTimeout
+	Timeout time.Duration
+	// Checksum 迁移内容的校验值, 运行后记录到数据库, 为空时使用Content或Description的SHA-256, 都为空时不校验
+	Checksum string
+	// Content 迁移的内容(例如迁移使用的SQL), 用于计算校验值, 修改已运行迁移的Content会被发现
+	Content string
+	// Source 迁移定义的位置, 开启Options.CaptureSource时自动记录, SQL文件迁移为文件名
+	Source string
+	// SQL文件迁移的up语句, 用于检查DDL
+	statements []string
 }
 
 // XorMigrate 进行迁移
 type XorMigrate struct {
-	db         *xorm.Engine
-	tx         *xorm.Session
+	db *xorm.Engine
+	tx *xorm.Session
+	// 开启SessionTimezone时运行期间db替换为设置了时区的引擎, appDB为原来的引擎
+	appDB *xorm.Engine
+	// NewMulti注册的所有数据库, 包括db
+	engines    map[string]*xorm.Engine
 	options    *Options
 	migrations []*Migration
 	initSchema InitSchemaFunc
+	// 通过MigrateAs运行时的发布标识
+	deployID string
+	// 本次运行预期的已运行迁移, 用于发现其他进程同时修改了迁移表, 为nil时不检查
+	expectedApplied map[string]struct{}
+	// 通过MigrateWhere运行时只运行filter返回true的迁移
+	filter func(*Migration) bool
+	// 通过MigrateToExclusive运行时在该迁移之前停止
+	stopBefore string
+	// 通过MigrateWithResult运行时收集运行结果
+	result *MigrateResult
+	// 通过RollbackLastReason等方法回滚时记录的原因
+	rollbackReason string
+	// WithValue设置的值, 通过context传给MigrateCtx
+	values []contextValue
+	// OptimisticLocking 本次运行声明迁移使用的标识
+	claimToken string
+	// 最近一次迁移是否运行了InitSchema
+	didInitSchema bool
+	// Pause后不为nil, Resume时关闭
+	pauseMu sync.Mutex
+	resumed chan struct{}
+	// 当前阶段, 通过CurrentOperation在其他goroutine中读取
+	opMu      sync.Mutex
+	op        string
+	opVersion string
+	opSince   time.Time
+	// 可替换的等待函数, 测试中使用
+	sleep func(ctx context.Context, d time.Duration) error
+	// 可替换的提交函数, 测试中使用
+	commitTx func(session *xorm.Session) error
+	// model使用的迁移表结构体类型, 第一次使用时生成
+	modelOnce sync.Once
+	modelType reflect.Type
 }
 
 // ReservedVersionError 错误使用保留version作为某次迁移version
@@ -76,13 +422,29 @@ func (e *DuplicatedVersionError) Error() string {
 	return fmt.Sprintf(`xormigrate: Duplicated migration Version: "%s"`, e.Version)
 }
 
+// VersionNotFoundError 迁移列表中不存在指定的Version, 可以用errors.Is匹配ErrMigrationVersionDoesNotExist
+type VersionNotFoundError struct {
+	Version string
+}
+
+func (e *VersionNotFoundError) Error() string {
+	return fmt.Sprintf(`xormigrate: Migration Version does not exist: "%s"`, e.Version)
+}
+
+func (e *VersionNotFoundError) Is(target error) bool {
+	return target == ErrMigrationVersionDoesNotExist
+}
+
 var (
 	// DefaultOptions 默认
 	DefaultOptions = &Options{
-		TableName:         "migrations",
-		VersionColumnName: "version",
-		VersionColumnSize: 255,
-		//UseTransaction:            false,
+		TableName:                 "migrations",
+		VersionColumnName:         "version",
+		VersionColumnSize:         255,
+		RollbackColumnName:        "is_rollback",
+		IDColumnName:              "id",
+		SuffixSeparator:           "_",
+		UseTransaction:            false,
 		ValidateUnknownMigrations: false,
 		HardDelete:                false,
 	}
@@ -96,6 +458,15 @@ var (
 	// ErrMissingVersion 当迁移Version等于""时
 	ErrMissingVersion = errors.New("xormigrate: Missing Version in migration")
 	
+	// ErrMissingMigrateFunc 迁移没有设置Migrate、MigrateMulti、MigrateCtx或MigrateTx
+	ErrMissingMigrateFunc = errors.New("xormigrate: Missing Migrate function in migration")
+	
+	// ErrMissingDescription 开启RequireDescription时迁移的Description为空
+	ErrMissingDescription = errors.New("xormigrate: Missing Description in migration")
+	
+	// ErrMigrationsOutOfOrder 开启ValidateOrder时迁移没有按version递增排列
+	ErrMigrationsOutOfOrder = errors.New("xormigrate: Migrations are not sorted by Version")
+	
 	// ErrNoRunMigration 在运行RollbackLast时发现正在运行迁移时返回
 	ErrNoRunMigration = errors.New("xormigrate: Could not find last run migration")
 	
@@ -104,6 +475,87 @@ var (
 	
 	// ErrUnknownPastMigration 迁移存在于数据库中但是不存在于代码中
 	ErrUnknownPastMigration = errors.New("xormigrate: Found migration in DB that does not exist in code")
+	
+	// ErrRemoveUnknownNotConfirmed 使用UnknownMigrationRemove但是没有开启ConfirmRemoveUnknownMigrations
+	ErrRemoveUnknownNotConfirmed = errors.New("xormigrate: Removing unknown migrations requires ConfirmRemoveUnknownMigrations")
+	
+	// ErrInvalidTimezone SessionTimezone不是合法的时区名称或偏移量
+	ErrInvalidTimezone = errors.New("xormigrate: Invalid session timezone")
+	
+	// ErrTimezoneNotSupported 当前数据库不支持设置会话时区
+	ErrTimezoneNotSupported = errors.New("xormigrate: Session timezone is not supported by this database")
+	
+	// ErrForeignKeyViolation 迁移后存在违反外键约束的数据
+	ErrForeignKeyViolation = errors.New("xormigrate: Found foreign key violations")
+	
+	// ErrNoBackup 恢复备份时找不到备份表
+	ErrNoBackup = errors.New("xormigrate: Could not find backup tables for this migration")
+	
+	// ErrMissingPrivileges 数据库用户缺少迁移需要的权限
+	ErrMissingPrivileges = errors.New("xormigrate: Database user is missing required privileges")
+	
+	// ErrNoSchemaChanges 模型和数据库结构一致, 没有需要生成的迁移
+	ErrNoSchemaChanges = errors.New("xormigrate: Models match the database schema, nothing to generate")
+	
+	// ErrChecksumMismatch 已运行迁移的校验值与代码中的不一致
+	ErrChecksumMismatch = errors.New("xormigrate: Checksum of applied migration does not match the code")
+	
+	// ErrSkipMigration Migrate返回该错误(可以用fmt.Errorf("%w: 原因", ErrSkipMigration)附加原因)时,
+	// 迁移记录为已运行并保存跳过的原因
+	ErrSkipMigration = errors.New("xormigrate: Migration skipped")
+	
+	// ErrTooManyPending 待执行的迁移数量超过Options.MaxPendingWarn
+	ErrTooManyPending = errors.New("xormigrate: Too many pending migrations")
+	
+	// ErrNoStoredRollback 迁移没有运行或者运行时没有保存回滚语句
+	ErrNoStoredRollback = errors.New("xormigrate: Could not find stored rollback SQL for this migration")
+	
+	// ErrLockNotAcquired 开启UseLock时没有获取到咨询锁
+	ErrLockNotAcquired = errors.New("xormigrate: Could not acquire advisory lock")
+	
+	// ErrClaimLost OptimisticLocking下完成迁移时发现声明记录已不属于本次运行
+	ErrClaimLost = errors.New("xormigrate: Migration claim was lost to another run")
+	
+	// ErrVersionTooLong 迁移version超过Options.VersionColumnSize
+	ErrVersionTooLong = errors.New("xormigrate: Version is longer than VersionColumnSize")
+	
+	// ErrRollbackFloorReached 回滚会越过Options.RollbackFloor
+	ErrRollbackFloorReached = errors.New("xormigrate: Refusing to roll back past the rollback floor")
+	
+	// ErrMigrationTimeout 迁移函数超过Migration.Timeout或Options.MigrationTimeout仍未返回
+	ErrMigrationTimeout = errors.New("xormigrate: Migration timed out")
+	
+	// ErrTableNotVisible 等待Options.WaitForTable后迁移表仍不可见
+	ErrTableNotVisible = errors.New("xormigrate: Migrations table is not visible")
+	
+	// ErrNoSchemaSnapshot 迁移没有运行或者运行时没有开启Options.SnapshotSchema
+	ErrNoSchemaSnapshot = errors.New("xormigrate: Could not find schema snapshot for this migration")
+	
+	// ErrConcurrentModification 运行期间其他进程修改了迁移表, 错误中列出新增(+)和消失(-)的迁移
+	ErrConcurrentModification = errors.New("xormigrate: Migrations table was modified concurrently")
+	
+	// ErrPrimaryEngineNotFound NewMulti的primary不在engines中
+	ErrPrimaryEngineNotFound = errors.New("xormigrate: Primary engine is not registered")
+	
+	// ErrNoEngines 使用MigrateMulti的迁移不是通过NewMulti创建的XorMigrate运行
+	ErrNoEngines = errors.New("xormigrate: MigrateMulti requires a migrator created by NewMulti")
+	
+	// ErrNoInitSchema 没有设置InitSchema或InitSchemaSQL, 无法对比
+	ErrNoInitSchema = errors.New("xormigrate: No init schema to verify")
+	// ErrSchemaDrift InitSchema建立的表结构与逐个运行迁移得到的不一致
+	ErrSchemaDrift = errors.New("xormigrate: Init schema does not match migrations")
+	
+	// ErrInitSchemaTablesExist 迁移表为空但Options.InitSchemaTables中的表已经存在
+	ErrInitSchemaTablesExist = errors.New("xormigrate: Tables created by InitSchema already exist")
+	
+	// ErrMigrationPanicked 开启RecoverPanics时迁移函数panic, 错误中包含迁移的version和panic的值
+	ErrMigrationPanicked = errors.New("xormigrate: Migration panicked")
+	
+	// ErrMultipleDDL 开启SingleDDLPerMigration时迁移包含多条DDL语句
+	ErrMultipleDDL = errors.New("xormigrate: Migration contains more than one DDL statement")
+	
+	// 时区偏移量, 例如 +08:00
+	timezoneOffsetRegexp = regexp.MustCompile(`^[+-](0[0-9]|1[0-4]):[0-5][0-9]$`)
 )
 
 // New Xormigrate.
@@ -117,11 +569,73 @@ func New(engine *xorm.Engine, options *Options, migrations []*Migration) *XorMig
 	if options.VersionColumnSize == 0 {
 		options.VersionColumnSize = DefaultOptions.VersionColumnSize
 	}
+	if options.SuffixSeparator == "" {
+		options.SuffixSeparator = DefaultOptions.SuffixSeparator
+	}
+	if options.RollbackColumnName == "" {
+		options.RollbackColumnName = DefaultOptions.RollbackColumnName
+	}
+	if options.IDColumnName == "" {
+		options.IDColumnName = DefaultOptions.IDColumnName
+	}
+	if options.CaptureSource {
+		for _, m := range migrations {
+			if m.Source == "" && m.Migrate != nil {
+				m.Source = funcSource(m.Migrate)
+			} else if m.Source == "" && m.MigrateMulti != nil {
+				m.Source = funcSource(m.MigrateMulti)
+			} else if m.Source == "" && m.MigrateCtx != nil {
+				m.Source = funcSource(m.MigrateCtx)
+			} else if m.Source == "" && m.MigrateTx != nil {
+				m.Source = funcSource(m.MigrateTx)
+			}
+		}
+	}
+	if options.AutoSort {
+		// 不修改调用方的切片
+		migrations = append([]*Migration(nil), migrations...)
+		less := sortLess(options)
+		sort.SliceStable(migrations, func(i, j int) bool {
+			return less(migrations[i].Version, migrations[j].Version)
+		})
+	}
 	return &XorMigrate{
 		db:         engine,
 		options:    options,
 		migrations: migrations,
+		sleep:      sleepContext,
+		commitTx:   (*xorm.Session).Commit,
+	}
+}
+
+// NewMulti 创建可以跨多个数据库迁移的XorMigrate
+// 迁移记录保存在primary对应的数据库中, Migrate和InitSchema也在primary上运行, MigrateMulti可以访问所有engines
+// 不保证跨数据库的原子性: 某个数据库修改失败时, 其他数据库已经完成的修改需要自行处理
+func NewMulti(engines map[string]*xorm.Engine, primary string, options *Options, migrations []*Migration) (*XorMigrate, error) {
+	engine, ok := engines[primary]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrPrimaryEngineNotFound, primary)
+	}
+	x := New(engine, options, migrations)
+	x.engines = make(map[string]*xorm.Engine, len(engines))
+	for name, e := range engines {
+		x.engines[name] = e
 	}
+	return x, nil
+}
+
+// DidInitSchema 最近一次Migrate是否运行了InitSchema
+// 数据库已经初始化过时InitSchema会被跳过, 此时没有定义迁移的Migrate什么也不做并返回nil, 可以通过该方法区分
+func (x *XorMigrate) DidInitSchema() bool {
+	return x.didInitSchema
+}
+
+// Config 返回填充默认值后实际生效的配置
+// 返回的是副本, 修改它不会影响迁移
+func (x *XorMigrate) Config() Options {
+	options := *x.options
+	options.InitSchemaSQL = append([]string(nil), x.options.InitSchemaSQL...)
+	return options
 }
 
 // InitSchema 如果没有发现迁移,则运行该函数
@@ -132,6 +646,12 @@ func (x *XorMigrate) InitSchema(initSchema InitSchemaFunc) {
 
 // Migrate 执行所有尚未运行的迁移
 func (x *XorMigrate) Migrate() error {
+	return x.MigrateContext(context.Background())
+}
+
+// MigrateContext 同Migrate, ctx会传递给迁移表的会话, 取消时中止正在执行的语句并回滚事务
+// ctx取消后不会再开始新的迁移, 返回*CancelledError
+func (x *XorMigrate) MigrateContext(ctx context.Context) error {
 	if !x.hasMigrations() {
 		return ErrNoMigrationDefined
 	}
@@ -139,19 +659,141 @@ func (x *XorMigrate) Migrate() error {
 	if len(x.migrations) > 0 {
 		targetMigrationVersion = x.migrations[len(x.migrations)-1].Version
 	}
-	return x.migrate(targetMigrationVersion)
+	return x.migrate(ctx, targetMigrationVersion)
+}
+
+// WithValue 设置一个运行时参数, 迁移可以在MigrateCtx中通过ctx.Value(key)读取, 返回x以便链式调用
+func (x *XorMigrate) WithValue(key, val interface{}) *XorMigrate {
+	x.values = append(x.values, contextValue{key: key, val: val})
+	return x
+}
+
+type contextValue struct {
+	key, val interface{}
+}
+
+// valueContext 返回带有WithValue设置的所有值的ctx
+func (x *XorMigrate) valueContext(ctx context.Context) context.Context {
+	for _, v := range x.values {
+		ctx = context.WithValue(ctx, v.key, v.val)
+	}
+	return ctx
+}
+
+// MigrateWithResult 同Migrate, 同时返回本次运行和跳过的迁移以及每个迁移所用的时间
+// 迁移失败时返回失败前的结果
+func (x *XorMigrate) MigrateWithResult() (*MigrateResult, error) {
+	result := &MigrateResult{Durations: make(map[string]time.Duration)}
+	x.result = result
+	defer func() {
+		x.result = nil
+	}()
+	start := time.Now()
+	err := x.Migrate()
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// MigrateAs 执行所有尚未运行的迁移, 并将本次运行的迁移标记为属于同一次发布deployID
+func (x *XorMigrate) MigrateAs(deployID string) error {
+	x.deployID = deployID
+	defer func() {
+		x.deployID = ""
+	}()
+	return x.Migrate()
+}
+
+// MigrateWhere 按顺序只运行pred返回true的未运行迁移, 其他迁移保持未运行
+// 选择性运行会在已运行的迁移之间留下未运行的迁移, 之后的Migrate会补上这些迁移
+func (x *XorMigrate) MigrateWhere(pred func(*Migration) bool) error {
+	return x.MigrateWhereContext(context.Background(), pred)
+}
+
+// MigrateWhereContext 同MigrateWhere, ctx的作用见MigrateContext
+func (x *XorMigrate) MigrateWhereContext(ctx context.Context, pred func(*Migration) bool) error {
+	x.filter = pred
+	defer func() {
+		x.filter = nil
+	}()
+	return x.MigrateContext(ctx)
+}
+
+// MigrateByTag 按顺序只运行带有标签tag的未运行迁移, 用于多个服务共享数据库时各自运行自己的迁移
+// 没有该标签的迁移(包括没有标签的迁移)保持未运行
+func (x *XorMigrate) MigrateByTag(tag string) error {
+	return x.MigrateByTagContext(context.Background(), tag)
+}
+
+// MigrateByTagContext 同MigrateByTag, ctx的作用见MigrateContext
+func (x *XorMigrate) MigrateByTagContext(ctx context.Context, tag string) error {
+	return x.MigrateWhereContext(ctx, func(m *Migration) bool {
+		return m.HasTag(tag)
+	})
+}
+
+// HasTag 返回迁移是否带有标签tag
+func (m *Migration) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MigrationsForDeploy 按执行顺序返回属于发布deployID且未回滚的迁移version
+func (x *XorMigrate) MigrationsForDeploy(deployID string) ([]string, error) {
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Cols(x.options.VersionColumnName).
+		Where(fmt.Sprintf("deploy_id = ? AND %s = 0", x.options.RollbackColumnName), deployID).
+		Asc(x.recordOrder()...).
+		QueryString()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0, len(rows))
+	for _, row := range rows {
+		versions = append(versions, row[x.options.VersionColumnName])
+	}
+	return versions, nil
 }
 
 // MigrateTo 根据migrationVersion进行迁移
 // MigrateTo 执行所有尚未运行的迁移,直到匹配' migrationVersion '的迁移
 func (x *XorMigrate) MigrateTo(migrationVersion string) error {
+	return x.MigrateToContext(context.Background(), migrationVersion)
+}
+
+// MigrateToExclusive 运行migrationVersion之前的所有迁移, 不运行migrationVersion本身, 用于分阶段发布
+func (x *XorMigrate) MigrateToExclusive(migrationVersion string) error {
+	return x.MigrateToExclusiveContext(context.Background(), migrationVersion)
+}
+
+// MigrateToExclusiveContext 同MigrateToExclusive, ctx的作用见MigrateContext
+func (x *XorMigrate) MigrateToExclusiveContext(ctx context.Context, migrationVersion string) error {
+	if err := x.checkVersionExist(migrationVersion); err != nil {
+		return err
+	}
+	x.stopBefore = migrationVersion
+	defer func() {
+		x.stopBefore = ""
+	}()
+	return x.migrate(ctx, migrationVersion)
+}
+
+// MigrateToContext 同MigrateTo, ctx的作用见MigrateContext
+func (x *XorMigrate) MigrateToContext(ctx context.Context, migrationVersion string) error {
 	if err := x.checkVersionExist(migrationVersion); err != nil {
 		return err
 	}
-	return x.migrate(migrationVersion)
+	return x.migrate(ctx, migrationVersion)
 }
 
-func (x *XorMigrate) migrate(migrationVersion string) error {
+func (x *XorMigrate) migrate(ctx context.Context, migrationVersion string) error {
+	x.setOperation(OperationValidating, "")
+	defer x.setOperation(OperationIdle, "")
+	
 	if !x.hasMigrations() {
 		return ErrNoMigrationDefined
 	}
@@ -164,105 +806,634 @@ func (x *XorMigrate) migrate(migrationVersion string) error {
 		return err
 	}
 	
-	x.begin()
+	if err := x.checkMigrateFuncs(); err != nil {
+		return err
+	}
+	
+	if err := x.checkDescriptions(); err != nil {
+		return err
+	}
+	
+	if err := x.checkOrder(); err != nil {
+		return err
+	}
+	
+	if err := x.checkSingleDDL(); err != nil {
+		return err
+	}
+	
+	if x.options.CheckPrivilegesFirst {
+		if err := x.CheckPrivileges(); err != nil {
+			return err
+		}
+	}
+	
+	if x.options.DryRun {
+		return x.dryRun(ctx, migrationVersion)
+	}
+	
+	if x.options.UseLock {
+		x.setOperation(OperationLocking, "")
+		unlock, err := x.acquireAdvisoryLock(ctx)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	
+	if x.options.LockMigrationsTable {
+		x.setOperation(OperationLocking, "")
+		if err := x.ensureLockRow(); err != nil {
+			return err
+		}
+	}
+	
+	if err := x.begin(ctx); err != nil {
+		return err
+	}
 	defer x.rollback()
 	
+	if x.options.LockMigrationsTable {
+		if err := x.lockMigrationsTable(); err != nil {
+			return err
+		}
+	}
+	
 	if err := x.createMigrationTableIfNotExists(); err != nil {
 		return err
 	}
 	
+	if x.options.WaitForTable > 0 {
+		if err := x.waitForMigrationTable(ctx); err != nil {
+			return err
+		}
+	}
+	
 	if x.options.ValidateUnknownMigrations {
-		unknownMigrations, err := x.unknownMigrationsHaveHappened()
-		if err != nil {
+		if err := x.resolveUnknownMigrations(); err != nil {
 			return err
 		}
-		if unknownMigrations {
-			return ErrUnknownPastMigration
+	}
+	
+	if x.options.BeforeMigrate != nil {
+		if err := x.options.BeforeMigrate(x.tx); err != nil {
+			return err
 		}
 	}
 	
-	if x.initSchema != nil {
+	x.didInitSchema = false
+	if x.hasInitSchema() {
 		canInitializeSchema, err := x.canInitializeSchema()
 		if err != nil {
 			return err
 		}
 		if canInitializeSchema {
+			x.setOperation(OperationInitSchema, "")
 			if err := x.runInitSchema(); err != nil {
 				return err
 			}
-			return x.commit()
+			if err := x.afterMigrate(); err != nil {
+				return err
+			}
+			x.setOperation(OperationCommitting, "")
+			versions := make([]string, 0, len(x.migrations))
+			for _, migration := range x.migrations {
+				versions = append(versions, migration.Version)
+			}
+			if err := x.commitMigrations(append([]string{initSchemaMigrationVersion}, versions...)); err != nil {
+				return err
+			}
+			x.didInitSchema = true
+			if x.result != nil {
+				x.result.Applied = versions
+			}
+			return x.afterCommit(versions)
+		}
+		if len(x.migrations) == 0 {
+			logger.Infof("schema is already initialized and no migrations are defined, nothing to do")
+		}
+	}
+	
+	if err := x.checkPendingLimit(migrationVersion); err != nil {
+		return err
+	}
+	
+	if x.options.OptimisticLocking {
+		token, err := newClaimToken()
+		if err != nil {
+			return err
+		}
+		x.claimToken = token
+	}
+	
+	// 没有锁保护时, 记录每个迁移前检查其他进程是否修改了迁移表
+	// OptimisticLocking允许并发运行, LockMigrationsTable保证运行依次执行, 都不需要检查
+	x.expectedApplied = nil
+	if !x.options.OptimisticLocking && !x.options.LockMigrationsTable {
+		applied, err := x.queryAppliedVersions()
+		if err != nil {
+			return err
+		}
+		x.expectedApplied = make(map[string]struct{}, len(applied))
+		for _, version := range applied {
+			x.expectedApplied[version] = struct{}{}
+		}
+	}
+	
+	if x.options.RecordRunPlan {
+		planned, err := x.plannedVersions(migrationVersion)
+		if err != nil {
+			return err
+		}
+		if err := x.startRunPlan(planned); err != nil {
+			return err
 		}
 	}
 	
+	var completed []string
 	for _, migration := range x.migrations {
-		if err := x.runMigration(migration); err != nil {
+		if err := ctx.Err(); err != nil {
+			return x.cancelledError(completed, "", err)
+		}
+		if err := x.pauseCheck(ctx); err != nil {
+			return x.cancelledError(completed, "", err)
+		}
+		if x.stopBefore != "" && migration.Version == x.stopBefore {
+			break
+		}
+		if x.filter != nil && !x.filter(migration) {
+			continue
+		}
+		migrationRan, err := x.migrationRan(migration)
+		if err != nil {
+			if ctx.Err() != nil {
+				return x.cancelledError(completed, "", ctx.Err())
+			}
+			return err
+		}
+		if !migrationRan && len(completed) > 0 && x.options.InterMigrationDelay > 0 {
+			logger.Debugf("waiting %s before migration %s", x.options.InterMigrationDelay, migration.Version)
+			if err := x.sleep(ctx, x.options.InterMigrationDelay); err != nil {
+				return x.cancelledError(completed, "", err)
+			}
+		}
+		if !migrationRan {
+			x.setOperation(OperationMigrating, migration.Version)
+		}
+		start := time.Now()
+		if err := x.runMigration(ctx, migration); err != nil {
+			if ctx.Err() != nil {
+				return x.cancelledError(completed, migration.Version, ctx.Err())
+			}
 			return err
 		}
+		if !migrationRan {
+			completed = append(completed, migration.Version)
+			x.recordResult(migration.Version, time.Since(start))
+		}
 		if migrationVersion != "" && migration.Version == migrationVersion {
 			break
 		}
 	}
-	return x.commit()
+	if x.options.RecordRunPlan {
+		if err := x.clearRunPlan(); err != nil {
+			return err
+		}
+	}
+	if err := x.afterMigrate(); err != nil {
+		return err
+	}
+	x.setOperation(OperationCommitting, "")
+	if err := x.commitMigrations(completed); err != nil {
+		return err
+	}
+	return x.afterCommit(completed)
 }
 
-// 如果有一个已定义的initSchema函数,或者如果迁移列表不为空,则会进行迁移
-func (x *XorMigrate) hasMigrations() bool {
-	return x.initSchema != nil || len(x.migrations) > 0
+// cancelledError 返回Migrate取消时的错误, 开启LockMigrationsTable时事务会被回滚, 已完成的迁移不会被保存
+func (x *XorMigrate) cancelledError(completed []string, interrupted string, err error) *CancelledError {
+	if x.options.LockMigrationsTable {
+		completed = nil
+	}
+	return &CancelledError{Completed: completed, Interrupted: interrupted, Err: err}
 }
 
-// 检查是否有迁移使用保留Version,目前只有一个"SCHEMA_INIT"
-func (x *XorMigrate) checkReservedVersion() error {
-	for _, m := range x.migrations {
-		if m.Version == initSchemaMigrationVersion {
-			return &ReservedVersionError{Version: m.Version}
-		}
+// CurrentOperation 返回正在进行的迁移阶段、迁移的version(只有OperationMigrating时不为空)和进入该阶段的时间
+// 可以在迁移运行时从其他goroutine调用, 例如在健康检查接口中展示进度
+func (x *XorMigrate) CurrentOperation() (op string, version string, since time.Time) {
+	x.opMu.Lock()
+	defer x.opMu.Unlock()
+	return x.op, x.opVersion, x.opSince
+}
+
+func (x *XorMigrate) setOperation(op, version string) {
+	x.opMu.Lock()
+	defer x.opMu.Unlock()
+	x.op, x.opVersion, x.opSince = op, version, time.Now()
+}
+
+// recordResult 通过MigrateWithResult运行时记录迁移的结果, 跳过的迁移已经由recordSkippedMigration记录
+func (x *XorMigrate) recordResult(version string, d time.Duration) {
+	if x.result == nil {
+		return
+	}
+	x.result.Durations[version] = d
+	if n := len(x.result.Skipped); n == 0 || x.result.Skipped[n-1] != version {
+		x.result.Applied = append(x.result.Applied, version)
 	}
-	return nil
 }
 
-// 检查重复Version
-func (x *XorMigrate) checkDuplicatedVersion() error {
-	lookup := make(map[string]struct{}, len(x.migrations))
-	for _, m := range x.migrations {
-		if _, ok := lookup[m.Version]; ok {
-			return &DuplicatedVersionError{Version: m.Version}
-		}
-		lookup[m.Version] = struct{}{}
+// afterMigrate 提交前调用AfterMigrate
+func (x *XorMigrate) afterMigrate() error {
+	if x.options.AfterMigrate == nil {
+		return nil
 	}
-	return nil
+	return x.options.AfterMigrate(x.tx)
 }
 
-func (x *XorMigrate) checkVersionExist(migrationVersion string) error {
-	for _, migrate := range x.migrations {
-		if migrate.Version == migrationVersion {
-			return nil
-		}
+// afterCommit 提交成功后调用OnCommit, 没有运行任何迁移时不调用
+func (x *XorMigrate) afterCommit(versions []string) error {
+	if x.options.OnCommit == nil || len(versions) == 0 {
+		return nil
 	}
-	return ErrMigrationVersionDoesNotExist
+	return x.options.OnCommit(versions)
 }
 
-// RollbackLast 回滚至上一次迁移
-func (x *XorMigrate) RollbackLast() error {
-	if len(x.migrations) == 0 {
-		return ErrNoMigrationDefined
+// dryRun 输出本次运行将要执行的迁移, 不运行迁移函数, 也不写入迁移表
+func (x *XorMigrate) dryRun(ctx context.Context, migrationVersion string) error {
+	if err := x.begin(ctx); err != nil {
+		return err
 	}
-	
-	x.begin()
 	defer x.rollback()
 	
-	lastRunMigration, err := x.getLastRunMigration()
+	initialize, err := x.CanInitializeSchema()
 	if err != nil {
 		return err
 	}
+	if initialize {
+		logger.Infof("dry run: would initialize schema with InitSchema and mark %d migrations as applied", len(x.migrations))
+		return nil
+	}
 	
-	if err := x.rollbackMigration(lastRunMigration); err != nil {
+	planned, err := x.plannedVersions(migrationVersion)
+	if err != nil {
 		return err
 	}
-	return x.commit()
-}
+	if len(planned) == 0 {
+		logger.Infof("dry run: no pending migrations")
+	}
+	for _, version := range planned {
+		logger.Infof("dry run: would apply migration %s: %s", version, x.findMigration(version).Description)
+	}
+	return nil
+}
+
+// plannedVersions 按执行顺序返回本次运行将要执行的迁移
+func (x *XorMigrate) plannedVersions(migrationVersion string) ([]string, error) {
+	pending, err := x.pendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, migration := range pending {
+		if x.stopBefore != "" && migration.Version == x.stopBefore {
+			break
+		}
+		if x.filter == nil || x.filter(migration) {
+			versions = append(versions, migration.Version)
+		}
+		if migration.Version == migrationVersion {
+			break
+		}
+	}
+	return versions, nil
+}
+
+// checkPendingLimit 本次运行需要执行的迁移数量超过MaxPendingWarn时输出警告, 开启MaxPendingFail时返回错误
+func (x *XorMigrate) checkPendingLimit(migrationVersion string) error {
+	if x.options.MaxPendingWarn <= 0 {
+		return nil
+	}
+	planned, err := x.plannedVersions(migrationVersion)
+	if err != nil {
+		return err
+	}
+	count := len(planned)
+	if count <= x.options.MaxPendingWarn {
+		return nil
+	}
+	if x.options.MaxPendingFail {
+		return fmt.Errorf("%w: %d pending, limit %d", ErrTooManyPending, count, x.options.MaxPendingWarn)
+	}
+	logger.Warnf("!!! %d pending migrations exceed the limit of %d, consider running them in a maintenance window !!!", count, x.options.MaxPendingWarn)
+	return nil
+}
+
+// Pause 暂停迁移, 正在运行的迁移不受影响, 但在Resume之前不会开始新的迁移
+func (x *XorMigrate) Pause() {
+	x.pauseMu.Lock()
+	defer x.pauseMu.Unlock()
+	if x.resumed == nil {
+		x.resumed = make(chan struct{})
+	}
+}
+
+// Resume 恢复被Pause暂停的迁移
+func (x *XorMigrate) Resume() {
+	x.pauseMu.Lock()
+	defer x.pauseMu.Unlock()
+	if x.resumed != nil {
+		close(x.resumed)
+		x.resumed = nil
+	}
+}
+
+// pauseCheck 在开始下一个迁移前调用, 暂停时等待Resume或者ctx取消
+func (x *XorMigrate) pauseCheck(ctx context.Context) error {
+	x.pauseMu.Lock()
+	resumed := x.resumed
+	x.pauseMu.Unlock()
+	if resumed == nil {
+		return nil
+	}
+	logger.Infof("migrations paused, waiting for resume")
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sleepContext 等待d, ctx取消时提前返回ctx.Err()
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// checkForeignKeysBeforeRecord 没有开启LockMigrationsTable时迁移表的会话不在事务中, 记录写入即生效,
+// 因此在写入记录前检查外键约束
+func (x *XorMigrate) checkForeignKeysBeforeRecord() error {
+	if !x.options.CheckForeignKeys || x.options.LockMigrationsTable {
+		return nil
+	}
+	return x.checkForeignKeys()
+}
+
+// commitMigrations 提交本次运行的迁移记录versions
+func (x *XorMigrate) commitMigrations(versions []string) error {
+	if x.options.CheckForeignKeys && x.options.LockMigrationsTable {
+		if err := x.checkForeignKeys(); err != nil {
+			return err
+		}
+	}
+	err := x.commit()
+	if err == nil || !x.options.VerifyAfterCommitError || len(versions) == 0 {
+		return err
+	}
+	return x.verifyCommit(versions, err)
+}
+
+// verifyCommit 提交失败后通过新的连接查询versions是否已经写入
+func (x *XorMigrate) verifyCommit(versions []string, commitErr error) *CommitError {
+	e := &CommitError{Versions: versions, Err: commitErr}
+	if e.VerifyErr = x.db.Ping(); e.VerifyErr != nil {
+		return e
+	}
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Cols(x.options.VersionColumnName).
+		In(x.options.VersionColumnName, versions).
+		Where(fmt.Sprintf("%s = 0", x.options.RollbackColumnName)).
+		QueryString()
+	if err != nil {
+		e.VerifyErr = err
+		return e
+	}
+	persisted := make(map[string]struct{}, len(rows))
+	for _, row := range rows {
+		persisted[row[x.options.VersionColumnName]] = struct{}{}
+	}
+	for _, version := range versions {
+		if _, ok := persisted[version]; !ok {
+			e.Missing = append(e.Missing, version)
+		}
+	}
+	e.Verified = true
+	e.Persisted = len(e.Missing) == 0
+	return e
+}
+
+// 如果有一个已定义的initSchema函数,或者如果迁移列表不为空,则会进行迁移
+func (x *XorMigrate) hasMigrations() bool {
+	return x.hasInitSchema() || len(x.migrations) > 0
+}
+
+func (x *XorMigrate) hasInitSchema() bool {
+	return x.initSchema != nil || len(x.options.InitSchemaSQL) > 0
+}
+
+// 检查是否有迁移使用保留Version,目前只有一个"SCHEMA_INIT"
+func (x *XorMigrate) checkReservedVersion() error {
+	for _, m := range x.migrations {
+		if m.Version == initSchemaMigrationVersion || m.Version == lockMigrationVersion {
+			return &ReservedVersionError{Version: m.Version}
+		}
+	}
+	return nil
+}
+
+// 检查重复Version
+func (x *XorMigrate) checkDuplicatedVersion() error {
+	lookup := make(map[string]struct{}, len(x.migrations))
+	for _, m := range x.migrations {
+		if _, ok := lookup[m.Version]; ok {
+			return &DuplicatedVersionError{Version: m.Version}
+		}
+		lookup[m.Version] = struct{}{}
+	}
+	return nil
+}
+
+// 检查所有迁移都设置了迁移函数, 避免运行时空指针
+func (x *XorMigrate) checkMigrateFuncs() error {
+	for _, m := range x.migrations {
+		if m.Migrate == nil && m.MigrateMulti == nil && m.MigrateCtx == nil && m.MigrateTx == nil {
+			return fmt.Errorf("%w: %s", ErrMissingMigrateFunc, m.Version)
+		}
+	}
+	return nil
+}
+
+// 开启RequireDescription时检查所有迁移都有Description
+func (x *XorMigrate) checkDescriptions() error {
+	if !x.options.RequireDescription {
+		return nil
+	}
+	var missing []string
+	for _, m := range x.migrations {
+		if strings.TrimSpace(m.Description) == "" {
+			missing = append(missing, m.Version)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrMissingDescription, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// 开启ValidateOrder时检查迁移按version严格递增, 比较方式见Options.VersionLess
+func (x *XorMigrate) checkOrder() error {
+	if !x.options.ValidateOrder {
+		return nil
+	}
+	less := sortLess(x.options)
+	for i := 1; i < len(x.migrations); i++ {
+		prev, cur := x.migrations[i-1].Version, x.migrations[i].Version
+		if !less(prev, cur) {
+			return fmt.Errorf("%w: %s is registered before %s", ErrMigrationsOutOfOrder, prev, cur)
+		}
+	}
+	return nil
+}
+
+// 根据version查找迁移, 不存在时返回nil
+func (x *XorMigrate) findMigration(version string) *Migration {
+	for _, migration := range x.migrations {
+		if migration.Version == version {
+			return migration
+		}
+	}
+	return nil
+}
+
+func (x *XorMigrate) checkVersionExist(migrationVersion string) error {
+	for _, migrate := range x.migrations {
+		if migrate.Version == migrationVersion {
+			return nil
+		}
+	}
+	return &VersionNotFoundError{Version: migrationVersion}
+}
+
+// Step 按顺序运行接下来的n个未运行迁移, n为负数时从最后一个已运行的迁移开始回滚-n个迁移
+// 未运行(或已运行)的迁移不足n个时全部运行(或回滚), n为0时什么都不做
+func (x *XorMigrate) Step(n int) error {
+	return x.StepContext(context.Background(), n)
+}
+
+// StepContext 同Step, ctx会传递给迁移表的会话, 作用见MigrateContext和RollbackLastContext
+func (x *XorMigrate) StepContext(ctx context.Context, n int) error {
+	switch {
+	case n > 0:
+		pending, err := x.pendingMigrations()
+		if err != nil {
+			return err
+		}
+		if len(pending) == 0 {
+			return nil
+		}
+		if n > len(pending) {
+			n = len(pending)
+		}
+		return x.MigrateToContext(ctx, pending[n-1].Version)
+	case n < 0:
+		return x.stepBack(ctx, -n)
+	}
+	return nil
+}
+
+// stepBack 从最后一个已运行的迁移开始依次回滚n个迁移
+func (x *XorMigrate) stepBack(ctx context.Context, n int) error {
+	if len(x.migrations) == 0 {
+		return ErrNoMigrationDefined
+	}
+	
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := x.begin(ctx); err != nil {
+		return err
+	}
+	defer x.rollback()
+	
+	for i := 0; i < n; i++ {
+		lastRunMigration, err := x.getLastRunMigration()
+		if errors.Is(err, ErrNoRunMigration) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := x.rollbackMigration(lastRunMigration); err != nil {
+			return err
+		}
+	}
+	return x.commit()
+}
+
+// RollbackLast 回滚至上一次迁移
+func (x *XorMigrate) RollbackLast() error {
+	return x.RollbackLastContext(context.Background())
+}
+
+// RollbackLastContext 同RollbackLast, ctx会传递给迁移表的会话, 取消时中止正在执行的语句并回滚事务
+func (x *XorMigrate) RollbackLastContext(ctx context.Context) error {
+	if len(x.migrations) == 0 {
+		return ErrNoMigrationDefined
+	}
+	
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := x.begin(ctx); err != nil {
+		return err
+	}
+	defer x.rollback()
+	
+	lastRunMigration, err := x.getLastRunMigration()
+	if err != nil {
+		return err
+	}
+	
+	if err := x.rollbackMigration(lastRunMigration); err != nil {
+		return err
+	}
+	return x.commit()
+}
+
+// RollbackLastReason 同RollbackLast, 并记录回滚的原因, 为空时使用Options.DefaultRollbackReason
+func (x *XorMigrate) RollbackLastReason(reason string) error {
+	x.rollbackReason = reason
+	defer func() {
+		x.rollbackReason = ""
+	}()
+	return x.RollbackLast()
+}
 
 // RollbackTo 回滚至指定Version
 func (x *XorMigrate) RollbackTo(migrationVersion string) error {
+	return x.RollbackToContext(context.Background(), migrationVersion)
+}
+
+// RollbackToReason 同RollbackTo, 并记录回滚的原因, 为空时使用Options.DefaultRollbackReason
+func (x *XorMigrate) RollbackToReason(migrationVersion, reason string) error {
+	x.rollbackReason = reason
+	defer func() {
+		x.rollbackReason = ""
+	}()
+	return x.RollbackTo(migrationVersion)
+}
+
+// RollbackToContext 同RollbackTo, ctx会传递给迁移表的会话
+// ctx取消后不会再开始新的回滚, 记录已经完成的回滚后返回*CancelledError
+func (x *XorMigrate) RollbackToContext(ctx context.Context, migrationVersion string) error {
 	if len(x.migrations) == 0 {
 		return ErrNoMigrationDefined
 	}
@@ -271,110 +1442,1098 @@ func (x *XorMigrate) RollbackTo(migrationVersion string) error {
 		return err
 	}
 	
-	x.begin()
+	// 目标之后的迁移中有一个低于RollbackFloor时不回滚任何迁移
+	for i := len(x.migrations) - 1; i >= 0 && x.migrations[i].Version != migrationVersion; i-- {
+		if err := x.checkRollbackFloor(x.migrations[i].Version); err != nil {
+			return err
+		}
+	}
+	
+	return x.rollbackDown(ctx, migrationVersion)
+}
+
+// RollbackAll 从最后一个迁移开始回滚所有已运行的迁移, 例如在测试之间清空数据库
+// 遇到不能回滚的迁移时停止, 返回ErrRollbackImpossible, 之前已经回滚的迁移仍会被记录
+func (x *XorMigrate) RollbackAll() error {
+	return x.RollbackAllContext(context.Background())
+}
+
+// RollbackAllContext 同RollbackAll, ctx的作用见RollbackToContext
+func (x *XorMigrate) RollbackAllContext(ctx context.Context) error {
+	if len(x.migrations) == 0 {
+		return ErrNoMigrationDefined
+	}
+	// 有迁移低于RollbackFloor时不回滚任何迁移
+	for _, migration := range x.migrations {
+		if err := x.checkRollbackFloor(migration.Version); err != nil {
+			return err
+		}
+	}
+	return x.rollbackDown(ctx, "")
+}
+
+// Refresh 回滚所有已运行的迁移后重新运行所有迁移, 用于本地开发时从头重建数据库
+// 有已运行的迁移没有Rollback时在回滚前返回ErrRollbackImpossible, 不会修改数据库
+func (x *XorMigrate) Refresh() error {
+	return x.RefreshContext(context.Background())
+}
+
+// RefreshContext 同Refresh, ctx会传递给回滚和迁移的会话
+func (x *XorMigrate) RefreshContext(ctx context.Context) error {
+	if len(x.migrations) == 0 {
+		return ErrNoMigrationDefined
+	}
+	exist, err := x.migrationTableExists()
+	if err != nil {
+		return err
+	}
+	if exist {
+		for _, migration := range x.migrations {
+			migrationRan, err := x.migrationRan(migration)
+			if err != nil {
+				return err
+			}
+			if migrationRan && !migration.canRollback() {
+				return fmt.Errorf("%w: %s", ErrRollbackImpossible, migration.Version)
+			}
+		}
+		if err := x.RollbackAllContext(ctx); err != nil {
+			return err
+		}
+	}
+	return x.MigrateContext(ctx)
+}
+
+// rollbackDown 从最后一个迁移开始依次回滚已运行的迁移, 直到migrationVersion(不回滚), 为空时回滚所有迁移
+func (x *XorMigrate) rollbackDown(ctx context.Context, migrationVersion string) error {
+	if err := x.begin(ctx); err != nil {
+		return err
+	}
 	defer x.rollback()
 	
+	// 迁移记录在所有回滚函数执行后一次更新, 使用RollbackTx的迁移在各自的事务中立即更新
+	// 回滚函数失败时, 已经回滚的迁移仍会被记录, 保持记录与数据库结构一致
+	var rolledBack, completed []string
+	stop := func(err error) error {
+		if markErr := x.recordRollback(rolledBack); markErr != nil {
+			return markErr
+		}
+		if commitErr := x.commit(); commitErr != nil {
+			return commitErr
+		}
+		return err
+	}
 	for i := len(x.migrations) - 1; i >= 0; i-- {
 		migration := x.migrations[i]
 		if migration.Version == migrationVersion {
 			break
 		}
+		if err := ctx.Err(); err != nil {
+			// 已取消的ctx无法再执行语句, 使用新的ctx记录已经完成的回滚
+			x.tx.Context(context.Background())
+			return stop(&CancelledError{Completed: completed, Err: err})
+		}
 		migrationRan, err := x.migrationRan(migration)
 		if err != nil {
 			return err
 		}
-		if migrationRan {
-			if err := x.rollbackMigration(migration); err != nil {
-				return err
+		if !migrationRan {
+			continue
+		}
+		if migration.RollbackTx != nil {
+			if err := x.rollbackMigrationTx(migration); err != nil {
+				return stop(err)
+			}
+		} else {
+			if err := x.runRollback(migration); err != nil {
+				return stop(err)
 			}
+			rolledBack = append(rolledBack, migration.Version)
 		}
+		completed = append(completed, migration.Version)
+	}
+	if err := x.recordRollback(rolledBack); err != nil {
+		return err
 	}
 	return x.commit()
 }
 
-func (x *XorMigrate) getLastRunMigration() (*Migration, error) {
-	for i := len(x.migrations) - 1; i >= 0; i-- {
-		migration := x.migrations[i]
-		
-		migrationRan, err := x.migrationRan(migration)
+// RollbackStored 执行运行迁移时保存的回滚语句(见Options.StoreRollbackSQL)并标记为已回滚
+// 不需要代码中定义该迁移, 可以在没有down文件的程序中回滚
+func (x *XorMigrate) RollbackStored(version string) error {
+	return x.RollbackStoredContext(context.Background(), version)
+}
+
+// RollbackStoredContext 同RollbackStored, ctx会传递给迁移表的会话
+func (x *XorMigrate) RollbackStoredContext(ctx context.Context, version string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := x.checkRollbackFloor(version); err != nil {
+		return err
+	}
+	if err := x.begin(ctx); err != nil {
+		return err
+	}
+	defer x.rollback()
+	
+	rows, err := x.tx.
+		Table(x.options.TableName).
+		Cols("rollback_sql").
+		Where(fmt.Sprintf("%s = ? AND %s = 0", x.options.VersionColumnName, x.options.RollbackColumnName), version).
+		QueryString()
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 || rows[0]["rollback_sql"] == "" {
+		return fmt.Errorf("%w: %s", ErrNoStoredRollback, version)
+	}
+	var statements []string
+	if err := json.Unmarshal([]byte(rows[0]["rollback_sql"]), &statements); err != nil {
+		return err
+	}
+	if err := execSQL(statements)(x.db); err != nil {
+		return err
+	}
+	if err := x.recordRollback([]string{version}); err != nil {
+		return err
+	}
+	return x.commit()
+}
+
+// RollbackPlan 按执行顺序返回RollbackTo(migrationVersion)会回滚的迁移, 不会执行回滚
+// 其中有不可回滚的迁移时, 仍返回完整的计划, 同时返回包含这些迁移的ErrRollbackImpossible
+func (x *XorMigrate) RollbackPlan(migrationVersion string) ([]string, error) {
+	if len(x.migrations) == 0 {
+		return nil, ErrNoMigrationDefined
+	}
+	if err := x.checkVersionExist(migrationVersion); err != nil {
+		return nil, err
+	}
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return nil, err
+	}
+	
+	var plan, irreversible []string
+	for i := len(x.migrations) - 1; i >= 0; i-- {
+		migration := x.migrations[i]
+		if migration.Version == migrationVersion {
+			break
+		}
+		migrationRan, err := x.migrationRan(migration)
+		if err != nil {
+			return nil, err
+		}
+		if !migrationRan {
+			continue
+		}
+		plan = append(plan, migration.Version)
+		if !migration.canRollback() {
+			irreversible = append(irreversible, migration.Version)
+		}
+	}
+	if len(irreversible) > 0 {
+		return plan, fmt.Errorf("%w: %s", ErrRollbackImpossible, strings.Join(irreversible, ", "))
+	}
+	return plan, nil
+}
+
+// ManifestHash 按顺序对所有迁移的Version、Description和Checksum计算SHA-256
+// 可以在CI中与提交的值比较, 发现迁移被意外增加、删除或调整顺序
+func (x *XorMigrate) ManifestHash() string {
+	h := sha256.New()
+	for _, migration := range x.migrations {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\n", migration.Version, migration.Description, migration.checksum())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DowntimeMigrations 返回尚未运行且标记为需要停机的迁移version
+func (x *XorMigrate) DowntimeMigrations() ([]string, error) {
+	pending, err := x.pendingMigrations()
+	if err != nil {
+		return nil, err
+	}
+	var versions []string
+	for _, migration := range pending {
+		if migration.RequiresDowntime {
+			versions = append(versions, migration.Version)
+		}
+	}
+	return versions, nil
+}
+
+// Pending 按定义顺序返回尚未运行(或已回滚)的迁移, 即Migrate将会运行的迁移, 不会修改数据库
+func (x *XorMigrate) Pending() ([]*Migration, error) {
+	return x.pendingMigrations()
+}
+
+// Migration 按version查找定义的迁移, 不存在时第二个返回值为false
+func (x *XorMigrate) Migration(version string) (*Migration, bool) {
+	migration := x.findMigration(version)
+	return migration, migration != nil
+}
+
+// GetMigration 同Migration, 可以在RollbackMigration之前查看迁移的Description和是否有Rollback
+func (x *XorMigrate) GetMigration(version string) (*Migration, bool) {
+	return x.Migration(version)
+}
+
+// HasRun 返回version对应的迁移是否已经运行(且没有回滚), 迁移表不存在时返回false
+func (x *XorMigrate) HasRun(version string) (bool, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return false, err
+	}
+	return x.migrationRan(&Migration{Version: version})
+}
+
+// 返回尚未运行的迁移, 迁移表不存在时所有迁移都未运行
+func (x *XorMigrate) pendingMigrations() ([]*Migration, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil {
+		return nil, err
+	}
+	if !exist {
+		return append([]*Migration(nil), x.migrations...), nil
+	}
+	
+	var pending []*Migration
+	for _, migration := range x.migrations {
+		migrationRan, err := x.migrationRan(migration)
+		if err != nil {
+			return nil, err
+		}
+		if !migrationRan {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// RollbackDeploy 按执行顺序的逆序回滚属于发布deployID的所有迁移
+// 只要其中有一个迁移不可回滚, 就不会回滚任何迁移
+// 回滚在一个事务中进行, 所有迁移都使用RollbackTx时任何一个失败都不会修改数据库
+// Rollback函数通过engine执行, 其修改无法撤销, 失败前已经回滚的这类迁移仍会被记录, 保持记录与数据库结构一致
+func (x *XorMigrate) RollbackDeploy(deployID string) error {
+	return x.RollbackDeployContext(context.Background(), deployID)
+}
+
+// RollbackDeployContext 同RollbackDeploy, ctx会传递给回滚使用的会话
+func (x *XorMigrate) RollbackDeployContext(ctx context.Context, deployID string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	versions, err := x.MigrationsForDeploy(deployID)
+	if err != nil {
+		return err
+	}
+	
+	migrations := make([]*Migration, 0, len(versions))
+	for _, version := range versions {
+		migration := x.findMigration(version)
+		if migration == nil || !migration.canRollback() {
+			return fmt.Errorf("%w: %s", ErrRollbackImpossible, version)
+		}
+		if err := x.checkRollbackFloor(version); err != nil {
+			return err
+		}
+		migrations = append(migrations, migration)
+	}
+	
+	if !x.options.LockMigrationsTable && allRollbackTx(migrations) {
+		return x.withTransaction(func(session *xorm.Session) error {
+			session.Context(ctx)
+			for i := len(migrations) - 1; i >= 0; i-- {
+				if err := x.runRollback(migrations[i]); err != nil {
+					return err
+				}
+			}
+			return x.markRolledBack(versions)
+		})
+	}
+	
+	if err := x.begin(ctx); err != nil {
+		return err
+	}
+	defer x.rollback()
+	
+	for i := len(migrations) - 1; i >= 0; i-- {
+		if err := x.rollbackMigration(migrations[i]); err != nil {
+			return err
+		}
+	}
+	return x.commit()
+}
+
+// allRollbackTx 返回是否所有迁移都使用RollbackTx回滚
+func allRollbackTx(migrations []*Migration) bool {
+	for _, migration := range migrations {
+		if migration.RollbackTx == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (x *XorMigrate) getLastRunMigration() (*Migration, error) {
+	for i := len(x.migrations) - 1; i >= 0; i-- {
+		migration := x.migrations[i]
+		
+		migrationRan, err := x.migrationRan(migration)
+		if err != nil {
+			return nil, err
+		}
+		
+		if migrationRan {
+			return migration, nil
+		}
+	}
+	return nil, ErrNoRunMigration
+}
+
+// RollbackMigration 自定义回滚.
+func (x *XorMigrate) RollbackMigration(m *Migration) error {
+	return x.RollbackMigrationContext(context.Background(), m)
+}
+
+// RollbackMigrationContext 同RollbackMigration, ctx会传递给迁移表的会话
+func (x *XorMigrate) RollbackMigrationContext(ctx context.Context, m *Migration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := x.begin(ctx); err != nil {
+		return err
+	}
+	defer x.rollback()
+	
+	if err := x.rollbackMigration(m); err != nil {
+		return err
+	}
+	return x.commit()
+}
+
+func (x *XorMigrate) rollbackMigration(m *Migration) error {
+	if m.RollbackTx != nil {
+		return x.rollbackMigrationTx(m)
+	}
+	if err := x.runRollback(m); err != nil {
+		return err
+	}
+	return x.inMigrationTransaction(func() error {
+		return x.recordRollback([]string{m.Version})
+	})
+}
+
+// rollbackMigrationTx 在同一个事务中运行RollbackTx并标记迁移已回滚, 开启LockMigrationsTable时使用本次运行的事务
+func (x *XorMigrate) rollbackMigrationTx(m *Migration) error {
+	run := func(*xorm.Session) error {
+		if err := x.runRollback(m); err != nil {
+			return err
+		}
+		return x.markRolledBack([]string{m.Version})
+	}
+	if x.options.LockMigrationsTable {
+		return run(x.tx)
+	}
+	return x.withTransaction(run)
+}
+
+// canRollback 返回迁移是否设置了回滚函数
+func (m *Migration) canRollback() bool {
+	return m.Rollback != nil || m.RollbackTx != nil
+}
+
+// runRollback 只运行回滚函数, 不修改迁移记录
+func (x *XorMigrate) runRollback(m *Migration) error {
+	if err := x.checkRollbackFloor(m.Version); err != nil {
+		return err
+	}
+	if !m.canRollback() {
+		return fmt.Errorf("%w: %s", ErrRollbackImpossible, m.Version)
+	}
+	logger.Infof("rolling back migration %s", m.Version)
+	start := time.Now()
+	var err error
+	if m.RollbackTx != nil {
+		err = m.RollbackTx(x.tx)
+	} else {
+		err = m.Rollback(x.db)
+	}
+	if err != nil {
+		return migrationError(m, err)
+	}
+	logger.Infof("rolled back migration %s in %s", m.Version, time.Since(start))
+	return nil
+}
+
+// recordRollback 标记回滚函数已经执行完成的迁移, 失败时数据库已经回滚但记录仍为已运行, 输出错误日志
+func (x *XorMigrate) recordRollback(versions []string) error {
+	if err := x.markRolledBack(versions); err != nil {
+		logger.Errorf("migrations %s were rolled back but could not be marked as rolled back, the migrations table no longer matches the schema: %v",
+			strings.Join(versions, ", "), err)
+		return err
+	}
+	return nil
+}
+
+// checkRollbackFloor 回滚version会越过RollbackFloor时返回ErrRollbackFloorReached
+func (x *XorMigrate) checkRollbackFloor(version string) error {
+	if x.options.RollbackFloor == "" || x.versionLess(x.options.RollbackFloor, version) {
+		return nil
+	}
+	return fmt.Errorf("%w: %s is not above the floor %s", ErrRollbackFloorReached, version, x.options.RollbackFloor)
+}
+
+// markRolledBack 用一条语句把versions的迁移记录标记为已回滚
+func (x *XorMigrate) markRolledBack(versions []string) error {
+	if len(versions) == 0 {
+		return nil
+	}
+	var err error
+	// 进行硬删除
+	if x.options.HardDelete {
+		_, err = x.tx.Table(x.options.TableName).In(x.options.VersionColumnName, versions).Delete(x.model())
+		return err
+	}
+	_, err = x.tx.Table(x.options.TableName).In(x.options.VersionColumnName, versions).Update(map[string]interface{}{
+		x.options.RollbackColumnName: 1,
+		"rolled_back_at":             x.now(),
+		"rollback_reason":            truncate(x.currentRollbackReason(), rollbackReasonColumnSize),
+	})
+	return err
+}
+
+// currentRollbackReason 返回本次回滚的原因
+func (x *XorMigrate) currentRollbackReason() string {
+	if x.rollbackReason != "" {
+		return x.rollbackReason
+	}
+	return x.options.DefaultRollbackReason
+}
+
+func (x *XorMigrate) runInitSchema() error {
+	// 先校验所有记录, 避免InitSchema运行后才发现无法记录
+	records, err := x.initSchemaRecords()
+	if err != nil {
+		return err
+	}
+	logger.Infof("initializing schema, %d migrations will be marked as applied", len(x.migrations))
+	start := time.Now()
+	if x.initSchema != nil {
+		if err := x.initSchema(x.db); err != nil {
+			return err
+		}
+	} else if err := x.runInitSchemaSQL(); err != nil {
+		return err
+	}
+	if err := x.checkForeignKeysBeforeRecord(); err != nil {
+		return err
+	}
+	if err := x.insertInitSchemaRecords(records); err != nil {
+		return err
+	}
+	logger.Infof("initialized schema in %s", time.Since(start))
+	return nil
+}
+
+// initSchemaRecords 返回InitSchema后需要写入的SCHEMA_INIT和所有迁移的记录, version超过VersionColumnSize时返回错误
+func (x *XorMigrate) initSchemaRecords() ([]map[string]interface{}, error) {
+	records := make([]map[string]interface{}, 0, len(x.migrations)+1)
+	add := func(m *Migration) error {
+		if int64(len(m.Version)) > x.options.VersionColumnSize {
+			return fmt.Errorf("%w: %s is longer than %d", ErrVersionTooLong, m.Version, x.options.VersionColumnSize)
+		}
+		records = append(records, x.migrationRecord(m))
+		return nil
+	}
+	if err := add(&Migration{Version: initSchemaMigrationVersion}); err != nil {
+		return nil, err
+	}
+	for _, migration := range x.migrations {
+		if err := add(migration); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// insertInitSchemaRecords 在同一个事务中写入所有记录, 要么全部成功要么全部不写入
+// x.tx已经开启事务时使用x.tx, 否则单独开启一个事务
+func (x *XorMigrate) insertInitSchemaRecords(records []map[string]interface{}) error {
+	session := x.tx
+	if !x.options.LockMigrationsTable {
+		session = x.db.NewSession()
+		defer session.Close()
+		if err := session.Begin(); err != nil {
+			return err
+		}
+	}
+	for _, record := range records {
+		if _, err := session.Table(x.options.TableName).Insert(record); err != nil {
+			return err
+		}
+	}
+	if session == x.tx {
+		return nil
+	}
+	return session.Commit()
+}
+
+// 逐条执行InitSchemaSQL, 从上次记录的进度之后开始
+func (x *XorMigrate) runInitSchemaSQL() error {
+	done, err := x.initSchemaProgress()
+	if err != nil {
+		return err
+	}
+	total := len(x.options.InitSchemaSQL)
+	if done > 0 {
+		logger.Infof("resuming init schema from statement %d/%d", done+1, total)
+	}
+	
+	for i := done; i < total; i++ {
+		if _, err := x.tx.Exec(x.options.InitSchemaSQL[i]); err != nil {
+			return fmt.Errorf("xormigrate: init schema statement %d/%d failed: %w", i+1, total, err)
+		}
+		if err := x.saveInitSchemaProgress(i + 1); err != nil {
+			return err
+		}
+		if x.options.InitSchemaProgress != nil {
+			x.options.InitSchemaProgress(i+1, total)
+		}
+	}
+	return x.clearInitSchemaProgress()
+}
+
+// 返回上次初始化已经完成的语句数
+func (x *XorMigrate) initSchemaProgress() (int, error) {
+	rows, err := x.tx.
+		Table(x.options.TableName).
+		Cols(x.options.VersionColumnName).
+		Where(fmt.Sprintf("%s LIKE ?", x.options.VersionColumnName), initSchemaProgressPrefix+"%").
+		QueryString()
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimPrefix(rows[0][x.options.VersionColumnName], initSchemaProgressPrefix))
+}
+
+func (x *XorMigrate) saveInitSchemaProgress(done int) error {
+	if err := x.clearInitSchemaProgress(); err != nil {
+		return err
+	}
+	return x.insertMigration(initSchemaProgressPrefix + strconv.Itoa(done))
+}
+
+func (x *XorMigrate) clearInitSchemaProgress() error {
+	_, err := x.tx.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s LIKE ?", x.options.VersionColumnName), initSchemaProgressPrefix+"%").
+		Delete(x.model())
+	return err
+}
+
+func (x *XorMigrate) runMigration(ctx context.Context, migration *Migration) error {
+	if len(migration.Version) == 0 {
+		return ErrMissingVersion
+	}
+	
+	action, err := x.checkChecksum(migration)
+	if err != nil {
+		return err
+	}
+	migrationRan, err := x.migrationRan(migration)
+	if err != nil {
+		return err
+	}
+	if migrationRan && action != ChecksumReapplyForce {
+		logger.Debugf("migration %s has already been applied, skipped", migration.Version)
+		if x.options.OnSkip != nil {
+			x.options.OnSkip(migration.Version)
+		}
+		return nil
+	}
+	if x.options.OptimisticLocking {
+		return x.runClaimedMigration(ctx, migration)
+	}
+	if migration.MigrateTx != nil {
+		err = x.runMigrationTx(ctx, migration)
+	} else {
+		err = x.runMigrationRecorded(ctx, migration)
+	}
+	if err != nil {
+		return err
+	}
+	if x.expectedApplied != nil {
+		x.expectedApplied[migration.Version] = struct{}{}
+	}
+	return nil
+}
+
+// checkConcurrentModification 记录迁移前确认已运行的迁移与本次运行预期的一致, 否则返回ErrConcurrentModification
+func (x *XorMigrate) checkConcurrentModification() error {
+	if x.expectedApplied == nil {
+		return nil
+	}
+	applied, err := x.queryAppliedVersions()
+	if err != nil {
+		return err
+	}
+	var changed []string
+	seen := make(map[string]struct{}, len(applied))
+	for _, version := range applied {
+		seen[version] = struct{}{}
+		if _, ok := x.expectedApplied[version]; !ok {
+			changed = append(changed, "+"+version)
+		}
+	}
+	for version := range x.expectedApplied {
+		if _, ok := seen[version]; !ok {
+			changed = append(changed, "-"+version)
+		}
+	}
+	if len(changed) == 0 {
+		return nil
+	}
+	sort.Strings(changed)
+	return fmt.Errorf("%w: %s", ErrConcurrentModification, strings.Join(changed, ", "))
+}
+
+// inMigrationTransaction 开启UseTransaction时在单独的事务中运行fn并提交, 否则直接运行fn
+func (x *XorMigrate) inMigrationTransaction(fn func() error) error {
+	if !x.options.UseTransaction || x.options.LockMigrationsTable {
+		return fn()
+	}
+	return x.withTransaction(func(*xorm.Session) error {
+		return fn()
+	})
+}
+
+// withTransaction 开启新的事务并在fn运行期间替换x.tx, fn成功后提交
+func (x *XorMigrate) withTransaction(fn func(session *xorm.Session) error) error {
+	session := x.db.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	tx := x.tx
+	x.tx = session
+	defer func() {
+		x.tx = tx
+	}()
+	if err := fn(session); err != nil {
+		return err
+	}
+	return x.commitTx(session)
+}
+
+// runMigrateFunc 运行MigrateMulti或Migrate
+func (x *XorMigrate) runMigrateFunc(parent context.Context, migration *Migration) error {
+	ctx := x.valueContext(parent)
+	timeout := migration.Timeout
+	if timeout == 0 {
+		timeout = x.options.MigrationTimeout
+	}
+	if timeout <= 0 {
+		return x.callMigrateFunc(ctx, x.db, migration)
+	}
+	
+	// 超时后取消传给MigrateCtx的ctx和MigrateTx所用事务中的查询, 不修改共享的引擎
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if migration.MigrateTx != nil {
+		// MigrateTx在当前goroutine中运行, 返回之后才会提交、回滚或替换事务, 超时通过事务的ctx中断查询
+		x.tx.Context(ctx)
+		err := x.callMigrateFunc(ctx, x.db, migration)
+		x.tx.Context(parent)
+		if err != nil && ctx.Err() != nil {
+			return x.migrationTimeoutError(parent, migration, timeout)
+		}
+		return err
+	}
+	
+	// Migrate和MigrateMulti使用的引擎不受ctx控制, 超时后无法中断, 会在后台继续运行直到返回
+	// 超时后本次运行结束时会关闭或恢复x.db, 迁移函数使用开始时的引擎
+	db := x.db
+	done := make(chan error, 1)
+	go func() {
+		done <- x.callMigrateFunc(ctx, db, migration)
+	}()
+	
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return x.migrationTimeoutError(parent, migration, timeout)
+	}
+}
+
+// migrationTimeoutError 迁移函数超时返回ErrMigrationTimeout, parent被取消时返回parent的错误
+func (x *XorMigrate) migrationTimeoutError(parent context.Context, migration *Migration, timeout time.Duration) error {
+	if parent.Err() != nil {
+		return parent.Err()
+	}
+	logger.Errorf("migration %s did not finish within %s", migration.Version, timeout)
+	return fmt.Errorf("%w: %s did not finish within %s", ErrMigrationTimeout, migration.Version, timeout)
+}
+
+// callMigrateFunc 运行迁移函数, db为Migrate和MigrateCtx使用的引擎
+func (x *XorMigrate) callMigrateFunc(ctx context.Context, db *xorm.Engine, migration *Migration) (err error) {
+	if x.options.RecoverPanics {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Errorf("migration %s panicked: %v\n%s", migration.Version, r, debug.Stack())
+				err = fmt.Errorf("%w: %s: %v", ErrMigrationPanicked, migration.Version, r)
+			}
+		}()
+	}
+	if migration.MigrateTx != nil {
+		return migration.MigrateTx(x.tx)
+	}
+	if migration.MigrateCtx != nil {
+		return migration.MigrateCtx(ctx, db)
+	}
+	if migration.MigrateMulti == nil {
+		return migration.Migrate(db)
+	}
+	if x.engines == nil {
+		return ErrNoEngines
+	}
+	return migration.MigrateMulti(x.engines)
+}
+
+// runMigrationRecorded 运行迁移函数, 然后记录迁移, 开启UseTransaction时记录在单独的事务中
+func (x *XorMigrate) runMigrationRecorded(ctx context.Context, migration *Migration) error {
+	record, err := x.executeMigration(ctx, migration)
+	if err != nil {
+		return err
+	}
+	if err := x.checkConcurrentModification(); err != nil {
+		return err
+	}
+	return x.inMigrationTransaction(record)
+}
+
+// runMigrationTx 在同一个事务中运行MigrateTx并记录迁移
+// 开启LockMigrationsTable时使用迁移表的事务, 否则为该迁移单独开启事务
+func (x *XorMigrate) runMigrationTx(ctx context.Context, migration *Migration) error {
+	if err := x.checkConcurrentModification(); err != nil {
+		return err
+	}
+	if x.options.LockMigrationsTable {
+		return x.executeAndRecord(ctx, migration)
+	}
+	return x.withTransaction(func(*xorm.Session) error {
+		return x.executeAndRecord(ctx, migration)
+	})
+}
+
+// executeAndRecord 运行迁移函数并立即记录迁移
+func (x *XorMigrate) executeAndRecord(ctx context.Context, migration *Migration) error {
+	record, err := x.executeMigration(ctx, migration)
+	if err != nil {
+		return err
+	}
+	return record()
+}
+
+// executeMigration 运行迁移函数(SkipIf为true时跳过), 返回之后记录迁移的函数
+func (x *XorMigrate) executeMigration(ctx context.Context, migration *Migration) (func() error, error) {
+	if migration.SkipIf != nil {
+		if skip, reason := migration.SkipIf(x.db); skip {
+			return func() error {
+				return x.recordSkippedMigration(migration, reason)
+			}, nil
+		}
+	}
+	var (
+		backups map[string]string
+		before  int64
+		err     error
+	)
+	if x.options.AutoBackup {
+		if backups, err = x.backupTables(migration); err != nil {
+			return nil, err
+		}
+	}
+	if x.options.RecordAffectedRows {
+		if before, err = x.countRows(migration.AffectedTables); err != nil {
+			return nil, err
+		}
+	}
+	if migration.Description != "" {
+		logger.Infof("applying migration %s: %s", migration.Version, migration.Description)
+	} else {
+		logger.Infof("applying migration %s", migration.Version)
+	}
+	x.warnMultipleDDL(migration)
+	start := time.Now()
+	if err := x.runMigrateFunc(ctx, migration); err != nil {
+		if errors.Is(err, ErrSkipMigration) {
+			reason := strings.TrimPrefix(err.Error(), ErrSkipMigration.Error()+": ")
+			return func() error {
+				if err := x.recordSkippedMigration(migration, reason); err != nil {
+					return err
+				}
+				return x.recordBackupTables(migration.Version, backups)
+			}, nil
+		}
+		x.warnImplicitCommit(migration)
+		return nil, migrationError(migration, err)
+	}
+	logger.Infof("applied migration %s in %s", migration.Version, time.Since(start))
+	if err := x.checkForeignKeysBeforeRecord(); err != nil {
+		return nil, err
+	}
+	var fingerprint string
+	if x.options.SnapshotSchema {
+		if fingerprint, err = x.schemaFingerprint(migration.AffectedTables); err != nil {
+			return nil, err
+		}
+	}
+	return func() error {
+		if err := x.recordExecutedMigration(migration, before, fingerprint); err != nil {
+			return err
+		}
+		return x.recordBackupTables(migration.Version, backups)
+	}, nil
+}
+
+// recordSkippedMigration 将跳过的迁移记录为已运行, 同时记录跳过的原因
+func (x *XorMigrate) recordSkippedMigration(migration *Migration, reason string) error {
+	logger.Infof("migration %s skipped: %s", migration.Version, reason)
+	if x.result != nil {
+		x.result.Skipped = append(x.result.Skipped, migration.Version)
+	}
+	if err := x.recordMigration(migration); err != nil {
+		return err
+	}
+	_, err := x.tx.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), migration.Version).
+		Update(map[string]interface{}{"skipped": 1, "skip_reason": reason})
+	return err
+}
+
+func (x *XorMigrate) recordExecutedMigration(migration *Migration, before int64, fingerprint string) error {
+	if err := x.recordMigration(migration); err != nil {
+		return err
+	}
+	if x.options.RecordAffectedRows {
+		if err := x.recordAffectedRows(migration, before); err != nil {
+			return err
+		}
+	}
+	if fingerprint != "" {
+		_, err := x.tx.
+			Table(x.options.TableName).
+			Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), migration.Version).
+			Update(map[string]interface{}{"schema_fingerprint": fingerprint})
+		if err != nil {
+			return err
+		}
+	}
+	if x.options.StoreRollbackSQL && len(migration.RollbackSQL) > 0 {
+		return x.storeRollbackSQL(migration)
+	}
+	return nil
+}
+
+// schemaFingerprint 返回tables的表名、列名和列类型的sha256, tables为空时包括迁移表以外的所有表
+func (x *XorMigrate) schemaFingerprint(tables []string) (string, error) {
+	metas, err := x.db.DBMetas()
+	if err != nil {
+		return "", err
+	}
+	wanted := make(map[string]struct{}, len(tables))
+	for _, table := range tables {
+		wanted[table] = struct{}{}
+	}
+	var lines []string
+	for _, table := range metas {
+		if table.Name == x.options.TableName {
+			continue
+		}
+		if _, ok := wanted[table.Name]; len(tables) > 0 && !ok {
+			continue
+		}
+		columns := make([]string, 0, len(table.Columns()))
+		for _, column := range table.Columns() {
+			columns = append(columns, column.Name+" "+column.SQLType.Name)
+		}
+		sort.Strings(columns)
+		lines = append(lines, fmt.Sprintf("%s(%s)", table.Name, strings.Join(columns, ",")))
+	}
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// storeRollbackSQL 以JSON数组保存回滚语句, 避免重新拆分语句
+func (x *XorMigrate) storeRollbackSQL(m *Migration) error {
+	data, err := json.Marshal(m.RollbackSQL)
+	if err != nil {
+		return err
+	}
+	_, err = x.tx.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), m.Version).
+		Update(map[string]interface{}{"rollback_sql": string(data)})
+	return err
+}
+
+// countRows 返回tables的总行数, 不存在的表视为0行
+func (x *XorMigrate) countRows(tables []string) (int64, error) {
+	var total int64
+	for _, table := range tables {
+		exist, err := x.tx.IsTableExist(table)
 		if err != nil {
-			return nil, err
+			return 0, err
 		}
-		
-		if migrationRan {
-			return migration, nil
+		if !exist {
+			continue
+		}
+		count, err := x.tx.Table(table).Count()
+		if err != nil {
+			return 0, err
 		}
+		total += count
 	}
-	return nil, ErrNoRunMigration
+	return total, nil
 }
 
-// RollbackMigration 自定义回滚.
-func (x *XorMigrate) RollbackMigration(m *Migration) error {
-	x.begin()
-	defer x.rollback()
-	
-	if err := x.rollbackMigration(m); err != nil {
+func (x *XorMigrate) recordAffectedRows(m *Migration, before int64) error {
+	after, err := x.countRows(m.AffectedTables)
+	if err != nil {
 		return err
 	}
-	return x.commit()
+	affected := after - before
+	if affected < 0 {
+		affected = -affected
+	}
+	logger.Infof("migration %s affected %d rows", m.Version, affected)
+	_, err = x.tx.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), m.Version).
+		Update(map[string]interface{}{"affected_rows": affected})
+	return err
 }
 
-func (x *XorMigrate) rollbackMigration(m *Migration) error {
-	if m.Rollback == nil {
-		return ErrRollbackImpossible
+// checksum 返回迁移的校验值, 没有设置Checksum时使用Content或Description的SHA-256
+func (m *Migration) checksum() string {
+	if m.Checksum != "" {
+		return m.Checksum
 	}
-	
-	if err := m.Rollback(x.db); err != nil {
-		return err
+	content := m.Content
+	if content == "" {
+		content = m.Description
 	}
-	
-	cond := fmt.Sprintf("%s = ?", x.options.VersionColumnName)
-	var err error
-	// 进行硬删除
-	if x.options.HardDelete {
-		_, err = x.tx.Table(x.options.TableName).Where(cond, m.Version).Delete(x.model())
-		return err
+	if content == "" {
+		return ""
 	}
-	_, err = x.tx.Table(x.options.TableName).Where(cond, m.Version).Update(map[string]interface{}{"is_rollback": 1})
-	return err
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
 }
 
-func (x *XorMigrate) runInitSchema() error {
-	if err := x.initSchema(x.db); err != nil {
-		return err
+// ChecksumMismatch 已运行迁移的校验值与代码中的不一致
+type ChecksumMismatch struct {
+	Version string
+	// Stored 数据库中记录的校验值
+	Stored string
+	// Current 代码中的校验值
+	Current string
+}
+
+// ValidateChecksums 比较所有已运行迁移记录的校验值和代码中的校验值, 返回全部不一致的迁移
+// 只检查, 不会运行或阻止迁移, 任意一方没有校验值的迁移不比较
+func (x *XorMigrate) ValidateChecksums() ([]ChecksumMismatch, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return nil, err
 	}
-	if err := x.insertMigration(initSchemaMigrationVersion); err != nil {
-		return err
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Cols(x.options.VersionColumnName, "checksum").
+		Where(fmt.Sprintf("%s = 0", x.options.RollbackColumnName)).
+		QueryString()
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]string, len(rows))
+	for _, row := range rows {
+		stored[row[x.options.VersionColumnName]] = row["checksum"]
 	}
 	
+	var mismatches []ChecksumMismatch
 	for _, migration := range x.migrations {
-		if err := x.insertMigration(migration.Version); err != nil {
-			return err
+		checksum, current := stored[migration.Version], migration.checksum()
+		if current == "" || checksum == "" || checksum == current {
+			continue
 		}
+		mismatches = append(mismatches, ChecksumMismatch{Version: migration.Version, Stored: checksum, Current: current})
 	}
-	
-	return nil
+	return mismatches, nil
 }
 
-func (x *XorMigrate) runMigration(migration *Migration) error {
-	if len(migration.Version) == 0 {
-		return ErrMissingVersion
+// checkChecksum 比较数据库中记录的校验值和代码中的校验值, 任意一方为空或开启SkipChecksumValidation时不比较
+func (x *XorMigrate) checkChecksum(m *Migration) (ChecksumAction, error) {
+	checksum := m.checksum()
+	if checksum == "" || x.options.SkipChecksumValidation {
+		return ChecksumIgnore, nil
+	}
+	rows, err := x.tx.
+		Table(x.options.TableName).
+		Cols("checksum").
+		Where(fmt.Sprintf("%s = ?", x.options.VersionColumnName), m.Version).
+		QueryString()
+	if err != nil || len(rows) == 0 {
+		return ChecksumIgnore, err
+	}
+	stored := rows[0]["checksum"]
+	if stored == "" || stored == checksum {
+		return ChecksumIgnore, nil
 	}
 	
-	migrationRan, err := x.migrationRan(migration)
+	if x.options.OnChecksumMismatch == nil {
+		return ChecksumFail, fmt.Errorf("%w: %s", ErrChecksumMismatch, m.Version)
+	}
+	action, err := x.options.OnChecksumMismatch(m.Version, stored, checksum)
 	if err != nil {
+		return action, err
+	}
+	if action == ChecksumFail {
+		return action, fmt.Errorf("%w: %s", ErrChecksumMismatch, m.Version)
+	}
+	logger.Warnf("checksum of migration %s changed from %s to %s", m.Version, stored, checksum)
+	return action, nil
+}
+
+// migrationError 迁移记录了Source时, 在错误中带上迁移定义的位置
+func migrationError(m *Migration, err error) error {
+	if m.Source == "" {
 		return err
 	}
-	if !migrationRan {
-		if err := migration.Migrate(x.db); err != nil {
-			return err
-		}
-		
-		if err := x.insertMigration(migration.Version); err != nil {
-			return err
-		}
+	logger.Errorf("migration %s defined at %s failed: %v", m.Version, m.Source, err)
+	return fmt.Errorf("xormigrate: migration %s defined at %s failed: %w", m.Version, m.Source, err)
+}
+
+// funcSource 返回函数定义的位置, 闭包为创建闭包的位置
+func funcSource(fn interface{}) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+	if f == nil {
+		return ""
 	}
-	return nil
+	file, line := f.FileLine(f.Entry())
+	return fmt.Sprintf("%s:%d", filepath.Base(file), line)
+}
+
+// recordOrder 返回迁移记录按运行顺序排序的列, 开启VersionAsPrimaryKey时没有自增主键, 按运行时间和version排序
+func (x *XorMigrate) recordOrder() []string {
+	if x.options.VersionAsPrimaryKey {
+		return []string{"migrated_at", x.options.VersionColumnName}
+	}
+	return []string{x.options.IDColumnName}
 }
 
 // model 返回指向动态创建的xorm迁移模型结构体值的指针
@@ -383,16 +2542,30 @@ func (x *XorMigrate) runMigration(migration *Migration) error {
 //	  ID string `xorm:"pk Options.IDColumnName size(Options.IDColumnSize)"`
 //	}
 func (x *XorMigrate) model() interface{} {
+	x.modelOnce.Do(func() {
+		x.modelType = x.buildModelType()
+	})
+	return reflect.New(x.modelType).Interface()
+}
+
+// buildModelType 根据Options反射生成迁移表的结构体类型, 结构只与Options有关, 由model缓存
+func (x *XorMigrate) buildModelType() reflect.Type {
+	types := columnTypesFor(x.db.Dialect().DBType())
 	g := reflect.StructField{
 		Name: reflect.ValueOf("ID").Interface().(string),
 		Type: reflect.TypeOf(""),
-		Tag:  reflect.StructTag(`xorm:"pk autoincr 'id' int"`),
+		Tag:  reflect.StructTag(fmt.Sprintf(`xorm:"pk autoincr '%s' %s"`, x.options.IDColumnName, types.id)),
+	}
+	versionConstraint := "unique"
+	if x.options.VersionAsPrimaryKey {
+		versionConstraint = "pk"
 	}
 	w := reflect.StructField{
 		Name: reflect.ValueOf("Version").Interface().(string),
 		Type: reflect.TypeOf(""),
 		Tag: reflect.StructTag(fmt.Sprintf(
-			`xorm:"notnull unique '%s' varchar(%d)"`,
+			`xorm:"notnull %s '%s' varchar(%d)"`,
+			versionConstraint,
 			x.options.VersionColumnName,
 			x.options.VersionColumnSize,
 		)),
@@ -400,27 +2573,185 @@ func (x *XorMigrate) model() interface{} {
 	c := reflect.StructField{
 		Name: reflect.ValueOf("IsRollback").Interface().(string),
 		Type: reflect.TypeOf(""),
-		Tag:  reflect.StructTag(`xorm:"default(0) int 'is_rollback'"`),
+		Tag:  reflect.StructTag(fmt.Sprintf(`xorm:"default(0) %s '%s'"`, types.flag, x.options.RollbackColumnName)),
+	}
+	d := reflect.StructField{
+		Name: reflect.ValueOf("DeployID").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"varchar(255) index 'deploy_id'"`),
+	}
+	
+	k := reflect.StructField{
+		Name: reflect.ValueOf("Checksum").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"varchar(255) 'checksum'"`),
+	}
+	
+	o := reflect.StructField{
+		Name: reflect.ValueOf("ClaimedBy").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"varchar(64) 'claimed_by'"`),
+	}
+	r := reflect.StructField{
+		Name: reflect.ValueOf("RollbackSQL").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"text 'rollback_sql'"`),
+	}
+	bt := reflect.StructField{
+		Name: reflect.ValueOf("BackupTables").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"text 'backup_tables'"`),
+	}
+	sk := reflect.StructField{
+		Name: reflect.ValueOf("Skipped").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(fmt.Sprintf(`xorm:"default(0) %s 'skipped'"`, types.flag)),
+	}
+	sr := reflect.StructField{
+		Name: reflect.ValueOf("SkipReason").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(fmt.Sprintf(`xorm:"%s 'skip_reason'"`, types.text(255))),
+	}
+	a := reflect.StructField{
+		Name: reflect.ValueOf("AffectedRows").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"default(0) bigint 'affected_rows'"`),
+	}
+	m := reflect.StructField{
+		Name: reflect.ValueOf("MigratedAt").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"datetime 'migrated_at'"`),
+	}
+	rb := reflect.StructField{
+		Name: reflect.ValueOf("RolledBackAt").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"datetime 'rolled_back_at'"`),
+	}
+	ds := reflect.StructField{
+		Name: reflect.ValueOf("Description").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(fmt.Sprintf(`xorm:"%s 'description'"`, types.text(descriptionColumnSize))),
+	}
+	rr := reflect.StructField{
+		Name: reflect.ValueOf("RollbackReason").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(fmt.Sprintf(`xorm:"%s 'rollback_reason'"`, types.text(rollbackReasonColumnSize))),
+	}
+	sf := reflect.StructField{
+		Name: reflect.ValueOf("SchemaFingerprint").Interface().(string),
+		Type: reflect.TypeOf(""),
+		Tag:  reflect.StructTag(`xorm:"varchar(64) 'schema_fingerprint'"`),
 	}
 	
-	structType := reflect.StructOf([]reflect.StructField{g, w, c})
-	structValue := reflect.New(structType).Elem()
-	//fmt.Printf("value: %+v\n", structValue.Addr().Interface())
-	return structValue.Addr().Interface()
+	fields := []reflect.StructField{g, w, c, d, ds, k, a, o, r, bt, sk, sr, m, rb, rr, sf}
+	if x.options.VersionAsPrimaryKey {
+		fields = fields[1:]
+	}
+	return reflect.StructOf(fields)
 }
 
+// modelColumnTypes 迁移表中随数据库变化的列类型
+type modelColumnTypes struct {
+	// id 自增主键
+	id string
+	// flag is_rollback、skipped等标记列, 查询中与0和1比较, 因此不使用boolean
+	flag string
+	// longText 描述、原因等不需要索引的文本, 为空时使用varchar
+	longText string
+}
+
+// columnTypesFor 返回各数据库习惯的列类型, 其他数据库使用通用的类型
+func columnTypesFor(dbType core.DbType) modelColumnTypes {
+	switch dbType {
+	case core.MYSQL:
+		return modelColumnTypes{id: "bigint", flag: "tinyint(1)"}
+	case core.POSTGRES:
+		return modelColumnTypes{id: "bigint", flag: "smallint", longText: "text"}
+	case core.SQLITE:
+		return modelColumnTypes{id: "integer", flag: "integer", longText: "text"}
+	default:
+		return modelColumnTypes{id: "int", flag: "int"}
+	}
+}
+
+// text 返回最多size个字符的文本列类型
+func (t modelColumnTypes) text(size int) string {
+	if t.longText != "" {
+		return t.longText
+	}
+	return fmt.Sprintf("varchar(%d)", size)
+}
+
+// 表已存在时Sync2只会补充旧版本迁移表缺少的列和索引
+// 设置了TableExistsFunc时只在表不存在时建表, 不会补充缺少的列
 func (x *XorMigrate) createMigrationTableIfNotExists() error {
-	exist, err := x.tx.IsTableExist(x.options.TableName)
-	if exist || err != nil {
+	if x.options.TableExistsFunc == nil && x.options.OnTableCreated == nil {
+		return x.tx.Table(x.options.TableName).Sync2(x.model())
+	}
+	exist, err := x.migrationTableExists()
+	if err != nil {
+		return err
+	}
+	if x.options.TableExistsFunc == nil {
+		if err := x.tx.Table(x.options.TableName).Sync2(x.model()); err != nil {
+			return err
+		}
+	} else if !exist {
+		if err := x.createMigrationTable(); err != nil {
+			return err
+		}
+	}
+	if !exist && x.options.OnTableCreated != nil {
+		return x.options.OnTableCreated(x.db, x.options.TableName)
+	}
+	return nil
+}
+
+func (x *XorMigrate) createMigrationTable() error {
+	model := x.model()
+	if err := x.tx.Table(x.options.TableName).CreateTable(model); err != nil {
+		return err
+	}
+	if err := x.tx.Table(x.options.TableName).CreateUniques(model); err != nil {
 		return err
 	}
-	return x.tx.Table(x.options.TableName).Sync2(x.model())
+	return x.tx.Table(x.options.TableName).CreateIndexes(model)
+}
+
+// waitForMigrationTable 轮询直到迁移表可见, 超过WaitForTable返回ErrTableNotVisible
+func (x *XorMigrate) waitForMigrationTable(ctx context.Context) error {
+	const interval = 100 * time.Millisecond
+	deadline := time.Now().Add(x.options.WaitForTable)
+	for {
+		exist, err := x.migrationTableExists()
+		if err != nil || exist {
+			return err
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%w: %s after %s", ErrTableNotVisible, x.options.TableName, x.options.WaitForTable)
+		}
+		logger.Debugf("waiting for migrations table %s to become visible", x.options.TableName)
+		if remaining > interval {
+			remaining = interval
+		}
+		if err := x.sleep(ctx, remaining); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *XorMigrate) migrationTableExists() (bool, error) {
+	if x.options.TableExistsFunc != nil {
+		return x.options.TableExistsFunc(x.db, x.options.TableName)
+	}
+	return x.db.IsTableExist(x.options.TableName)
 }
 
 func (x *XorMigrate) migrationRan(m *Migration) (bool, error) {
 	count, err := x.db.
 		Table(x.options.TableName).
-		Where(fmt.Sprintf("%s = ? AND is_rollback = 0", x.options.VersionColumnName), m.Version).Count()
+		Where(fmt.Sprintf("%s = ? AND %s = 0", x.options.VersionColumnName, x.options.RollbackColumnName), m.Version).Count()
 	return count > 0, err
 }
 
@@ -435,65 +2766,367 @@ func (x *XorMigrate) canInitializeSchema() (bool, error) {
 	}
 	
 	// If the Version doesn't exist, we also want the list of migrations to be empty
+	// 中途失败的InitSchemaSQL留下的进度记录和加锁、声明用的记录不算在内
 	var count int64
 	count, err = x.tx.
 		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s NOT LIKE ?", x.options.VersionColumnName), initSchemaProgressPrefix+"%").
+		And(fmt.Sprintf("%s NOT LIKE ?", x.options.VersionColumnName), claimMigrationPrefix+"%").
+		And(fmt.Sprintf("%s <> ?", x.options.VersionColumnName), lockMigrationVersion).
 		Count()
-	return count == 0, err
+	if err != nil || count > 0 {
+		return false, err
+	}
+	if err := x.checkInitSchemaTables(); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
-// 检测是否有未知的迁移发生,数据库中存在但是migrations中不存在
-func (x *XorMigrate) unknownMigrationsHaveHappened() (bool, error) {
-	rows, err := x.db.Table(x.options.TableName).Select(x.options.VersionColumnName).Rows(x.model())
+// CanInitializeSchema 返回下一次Migrate是否会运行InitSchema(或InitSchemaSQL), 不会修改数据库
+// 设置了InitSchemaTables时, 其中有表已经存在会返回ErrInitSchemaTablesExist
+func (x *XorMigrate) CanInitializeSchema() (bool, error) {
+	if !x.hasInitSchema() {
+		return false, nil
+	}
+	exist, err := x.migrationTableExists()
 	if err != nil {
 		return false, err
 	}
+	if !exist {
+		if err := x.checkInitSchemaTables(); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	
+	tx := x.tx
+	x.tx = x.db.NewSession()
+	defer func() {
+		x.tx.Close()
+		x.tx = tx
+	}()
+	return x.canInitializeSchema()
+}
+
+// checkInitSchemaTables InitSchemaTables中有表已经存在时返回ErrInitSchemaTablesExist
+func (x *XorMigrate) checkInitSchemaTables() error {
+	var existing []string
+	for _, table := range x.options.InitSchemaTables {
+		exist, err := x.db.IsTableExist(table)
+		if err != nil {
+			return err
+		}
+		if exist {
+			existing = append(existing, table)
+		}
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("%w: %s", ErrInitSchemaTablesExist, strings.Join(existing, ", "))
+	}
+	return nil
+}
+
+// 检测是否有未知的迁移发生,数据库中存在但是migrations中不存在, 返回这些迁移的version
+// UnknownMigrations 返回存在于迁移表中但代码中没有定义的迁移version, 迁移表不存在时返回nil
+// 开启TrustInitSchemaMarkers时不包括早于InitSchema初始化的记录
+func (x *XorMigrate) UnknownMigrations() ([]string, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return nil, err
+	}
+	return x.unknownMigrations()
+}
+
+func (x *XorMigrate) unknownMigrations() ([]string, error) {
+	trustBelow, err := x.initSchemaTrustPoint()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := x.db.Table(x.options.TableName).Select(x.options.VersionColumnName).Rows(x.model())
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 	
-	validVersionSet := make(map[string]struct{}, len(x.migrations)+1)
-	validVersionSet[initSchemaMigrationVersion] = struct{}{}
+	validVersionSet := make(map[string]struct{}, len(x.migrations))
 	for _, migration := range x.migrations {
 		validVersionSet[migration.Version] = struct{}{}
 	}
 	
+	var unknown []string
 	for rows.Next() {
 		var pastMigration = x.model()
 		if err = rows.Scan(pastMigration); err != nil {
-			return false, err
+			return nil, err
 		}
 		pm := reflect.Indirect(reflect.ValueOf(pastMigration))
-		if _, ok := validVersionSet[pm.Field(0).String()]; !ok {
-			return true, nil
+		version := pm.FieldByName("Version").String()
+		if isInternalVersion(version) || (trustBelow != "" && x.versionLess(version, trustBelow)) {
+			continue
+		}
+		if _, ok := validVersionSet[version]; !ok {
+			unknown = append(unknown, version)
+			// 软删除后重新迁移会留下同一version的多条记录
+			validVersionSet[version] = struct{}{}
+		}
+	}
+	
+	return unknown, nil
+}
+
+// initSchemaTrustPoint 开启TrustInitSchemaMarkers且数据库已经通过InitSchema初始化时,
+// 返回代码中第一个迁移的version, 小于它的记录视为被合并(squash)进InitSchema的迁移
+func (x *XorMigrate) initSchemaTrustPoint() (string, error) {
+	if !x.options.TrustInitSchemaMarkers || !x.hasInitSchema() || len(x.migrations) == 0 {
+		return "", nil
+	}
+	initialized, err := x.migrationRan(&Migration{Version: initSchemaMigrationVersion})
+	if err != nil || !initialized {
+		return "", err
+	}
+	return x.migrations[0].Version, nil
+}
+
+// 按照UnknownMigrationStrategy处理数据库中存在但是migrations中不存在的迁移
+func (x *XorMigrate) resolveUnknownMigrations() error {
+	unknown, err := x.unknownMigrations()
+	if err != nil || len(unknown) == 0 {
+		return err
+	}
+	
+	switch x.options.UnknownMigrationStrategy {
+	case UnknownMigrationWarn:
+		logger.Warnf("found migrations in DB that do not exist in code: %s", strings.Join(unknown, ", "))
+		return nil
+	case UnknownMigrationTreatAsApplied:
+		cond := fmt.Sprintf("%s = ? AND %s = 0", x.options.VersionColumnName, x.options.RollbackColumnName)
+		for _, version := range unknown {
+			count, err := x.tx.Table(x.options.TableName).Where(cond, version).Count()
+			if err != nil {
+				return err
+			}
+			if count > 0 {
+				continue
+			}
+			if err := x.insertMigration(version); err != nil {
+				return err
+			}
+		}
+		logger.Infof("treating unknown migrations as applied: %s", strings.Join(unknown, ", "))
+		return nil
+	case UnknownMigrationRemove:
+		if !x.options.ConfirmRemoveUnknownMigrations {
+			return ErrRemoveUnknownNotConfirmed
+		}
+		if _, err := x.tx.Table(x.options.TableName).In(x.options.VersionColumnName, unknown).Delete(x.model()); err != nil {
+			return err
+		}
+		logger.Warnf("removed migrations in DB that do not exist in code: %s", strings.Join(unknown, ", "))
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnknownPastMigration, strings.Join(unknown, ", "))
+}
+
+// FindDuplicateRecords 查找存在多条未回滚记录的version, 返回version及其记录数
+// 正常情况下每个version最多只有一条未回滚的记录, 出现重复说明迁移表已被损坏
+func (x *XorMigrate) FindDuplicateRecords() (map[string]int, error) {
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Select(fmt.Sprintf("%s, COUNT(*) AS total", x.options.VersionColumnName)).
+		Where(fmt.Sprintf("%s = 0", x.options.RollbackColumnName)).
+		GroupBy(x.options.VersionColumnName).
+		Having("COUNT(*) > 1").
+		QueryString()
+	if err != nil {
+		return nil, err
+	}
+	
+	duplicates := make(map[string]int, len(rows))
+	for _, row := range rows {
+		count, err := strconv.Atoi(row["total"])
+		if err != nil {
+			return nil, err
 		}
+		duplicates[row[x.options.VersionColumnName]] = count
+	}
+	return duplicates, nil
+}
+
+// DedupeRecords 修复重复记录, 每个version只保留id最小的一条未回滚记录, 返回删除的记录数
+// 开启VersionAsPrimaryKey时主键保证不会有重复记录, 直接返回0
+func (x *XorMigrate) DedupeRecords() (int64, error) {
+	if x.options.VersionAsPrimaryKey {
+		return 0, nil
+	}
+	duplicates, err := x.FindDuplicateRecords()
+	if err != nil || len(duplicates) == 0 {
+		return 0, err
+	}
+	
+	if err := x.begin(context.Background()); err != nil {
+		return 0, err
 	}
+	defer x.rollback()
 	
-	return false, nil
+	cond := fmt.Sprintf("%s = ? AND %s = 0", x.options.VersionColumnName, x.options.RollbackColumnName)
+	var removed int64
+	for version := range duplicates {
+		rows, err := x.tx.Table(x.options.TableName).Cols(x.options.IDColumnName).Where(cond, version).Asc(x.options.IDColumnName).QueryString()
+		if err != nil {
+			return 0, err
+		}
+		if len(rows) < 2 {
+			continue
+		}
+		ids := make([]string, 0, len(rows)-1)
+		for _, row := range rows[1:] {
+			ids = append(ids, row[x.options.IDColumnName])
+		}
+		n, err := x.tx.Table(x.options.TableName).In(x.options.IDColumnName, ids).Delete(x.model())
+		if err != nil {
+			return 0, err
+		}
+		removed += n
+	}
+	return removed, x.commit()
 }
 
 func (x *XorMigrate) insertMigration(version string) error {
-	var err error
-	record := map[string]interface{}{x.options.VersionColumnName: version}
+	return x.recordMigration(&Migration{Version: version})
+}
+
+// migrationRecord 返回迁移记录的列
+func (x *XorMigrate) migrationRecord(m *Migration) map[string]interface{} {
+	record := map[string]interface{}{
+		x.options.VersionColumnName: m.Version,
+		"migrated_at":               x.now(),
+	}
+	if x.deployID != "" {
+		record["deploy_id"] = x.deployID
+	}
+	if checksum := m.checksum(); checksum != "" {
+		record["checksum"] = checksum
+	}
+	if m.Description != "" {
+		record["description"] = truncate(m.Description, descriptionColumnSize)
+	}
+	return record
+}
+
+// recordMigration 记录迁移已运行, 已存在的记录(例如软删除回滚过的迁移)会被重新启用
+func (x *XorMigrate) recordMigration(m *Migration) error {
+	record := x.migrationRecord(m)
+	version := m.Version
+	cond := fmt.Sprintf("%s = ?", x.options.VersionColumnName)
+	count, err := x.tx.Table(x.options.TableName).Where(cond, version).Count()
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		record[x.options.RollbackColumnName] = 0
+		record["rolled_back_at"] = nil
+		record["rollback_reason"] = ""
+		record["skipped"] = 0
+		record["skip_reason"] = ""
+		_, err = x.tx.Table(x.options.TableName).Where(cond, version).Update(record)
+		return err
+	}
 	_, err = x.tx.Table(x.options.TableName).Insert(record)
 	return err
 }
 
-func (x *XorMigrate) begin() {
-	x.tx = x.db.NewSession()
+// now 按xorm写入datetime列的格式返回当前时间
+func (x *XorMigrate) now() string {
+	return time.Now().In(x.db.GetTZDatabase()).Format("2006-01-02 15:04:05")
+}
+
+func (x *XorMigrate) begin(ctx context.Context) error {
+	if err := x.useSessionTimezone(); err != nil {
+		return err
+	}
+	x.tx = x.db.NewSession().Context(ctx)
+	if x.options.LockMigrationsTable {
+		if err := x.tx.Begin(); err != nil {
+			x.rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+// useSessionTimezone 开启SessionTimezone时本次运行改用每个连接都设置了时区的引擎, rollback时关闭并恢复原来的引擎
+// SET time_zone只对执行它的连接有效, 直接在连接池中执行会设置到任意一个连接上, 并影响之后使用该连接的应用查询
+func (x *XorMigrate) useSessionTimezone() error {
+	if x.options.SessionTimezone == "" {
+		return nil
+	}
+	query, err := sessionTimezoneSQL(x.db.Dialect().DBType(), x.options.SessionTimezone)
+	if err != nil {
+		return err
+	}
+	engine, err := newSessionEngine(x.db, query)
+	if err != nil {
+		return err
+	}
+	x.appDB, x.db = x.db, engine
+	return nil
+}
+
+func sessionTimezoneSQL(dbType core.DbType, timezone string) (string, error) {
+	isOffset := timezoneOffsetRegexp.MatchString(timezone)
+	if !isOffset {
+		if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+			return "", fmt.Errorf("%w: %q", ErrInvalidTimezone, timezone)
+		}
+	}
+	switch dbType {
+	case core.MYSQL:
+		return fmt.Sprintf("SET time_zone = '%s'", timezone), nil
+	case core.POSTGRES:
+		// PostgreSQL会把'+08:00'按POSIX规则解析(符号相反), 偏移量需要使用INTERVAL
+		if isOffset {
+			return fmt.Sprintf("SET TIME ZONE INTERVAL '%s' HOUR TO MINUTE", timezone), nil
+		}
+		return fmt.Sprintf("SET TIME ZONE '%s'", timezone), nil
+	}
+	return "", fmt.Errorf("%w: %s", ErrTimezoneNotSupported, dbType)
 }
 
 func (x *XorMigrate) commit() error {
-	return x.tx.Commit()
+	return x.commitTx(x.tx)
 }
 
+// rollback 回滚未提交的事务并关闭会话, 已经提交时只关闭会话
+// 开启SessionTimezone时同时关闭本次运行使用的引擎
 func (x *XorMigrate) rollback() {
 	x.tx.Rollback()
+	x.tx.Close()
+	if x.appDB != nil {
+		x.db.Close()
+		x.db, x.appDB = x.appDB, nil
+	}
 }
 
-// GenVersion 根据时间戳 生成version
+// GenVersion 根据时间戳 生成version, 同GenVersion函数
 func (x *XorMigrate) GenVersion() string {
-	um := time.Now().UnixMicro()
-	t := time.UnixMicro(um)
-	// 格式化日期字符串
-	dateStr := t.Format("200601021504")
-	return dateStr
+	return GenVersion()
+}
+
+var (
+	genVersionMu   sync.Mutex
+	lastGenVersion time.Time
+)
+
+// GenVersion 根据当前时间生成精确到微秒的version, 例如 20230724103859123456
+// 同一进程中生成的version唯一且按字符串排序时与生成顺序一致
+func GenVersion() string {
+	genVersionMu.Lock()
+	defer genVersionMu.Unlock()
+	t := time.Now().Truncate(time.Microsecond)
+	if !t.After(lastGenVersion) {
+		t = lastGenVersion.Add(time.Microsecond)
+	}
+	lastGenVersion = t
+	return fmt.Sprintf("%s%06d", t.Format("20060102150405"), t.Nanosecond()/int(time.Microsecond))
 }
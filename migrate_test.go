@@ -1,11 +1,23 @@
 package migrate
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 	
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/go-xorm/xorm"
+	_ "github.com/mattn/go-sqlite3"
+	"xorm.io/core"
 )
 
 var mi = []*Migration{
@@ -31,7 +43,7 @@ var mi = []*Migration{
 			return err
 		},
 		Rollback: func(tx *xorm.Engine) error {
-			_, err := tx.Exec("ALTER TABLE pet ADD COLUMN (p_name varchar(255))")
+			_, err := tx.Exec("ALTER TABLE pet ADD COLUMN p_name varchar(255)")
 			return err
 		},
 	},
@@ -93,19 +105,24 @@ type Pet struct {
 }
 
 func TestMigrate(t *testing.T) {
-	Engine, err := xorm.NewEngine("mysql", "dns")
+	initmigrator, Engine, err := NewTestMigrator([]*Migration{})
 	if err != nil {
-		fmt.Println(err)
+		t.Fatal(err)
 	}
-	Engine.ShowSQL(true)
-	initmigrator := New(Engine, DefaultOptions, []*Migration{})
-	//initmigrator.model()
+	defer Engine.Close()
+	//Engine.ShowSQL(true)
 	migrator := New(Engine, DefaultOptions, mi)
 	initmigrator.InitSchema(func(engine *xorm.Engine) error {
 		return engine.Sync2(new(Pet), new(Person))
 	})
-	fmt.Println(initmigrator.Migrate())
-	fmt.Println(migrator.Migrate())
+	if err := initmigrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	assertColumns(t, Engine, "person", "name,age,address,a,b,c")
+	assertColumns(t, Engine, "pet", "name")
 	
 	//Engine.Table(&Person{}).Insert(map[string]interface{}{
 	//	"name": "lisy",
@@ -113,6 +130,3642 @@ func TestMigrate(t *testing.T) {
 	//	"a":    "aaa",
 	//	"b":    "bbb",
 	//})
-	//migrator.RollbackTo("202307241042_person")
-	migrator.RollbackLast()
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	assertColumns(t, Engine, "person", "name,age,address,a,b")
+	if err := migrator.RollbackTo("202307241038_person"); err != nil {
+		t.Fatal(err)
+	}
+	assertColumns(t, Engine, "person", "name,age,address")
+	assertColumns(t, Engine, "pet", "name,p_name")
+}
+
+func assertColumns(t *testing.T, engine *xorm.Engine, table, columns string) {
+	t.Helper()
+	tables, err := engine.DBMetas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tb := range tables {
+		if tb.Name == table {
+			if got := strings.Join(tb.ColumnsSeq(), ","); got != columns {
+				t.Fatalf("table %s: expected columns %s, got %s", table, columns, got)
+			}
+			return
+		}
+	}
+	t.Fatalf("table %s does not exist", table)
+}
+
+// newTestEngine 创建内存SQLite数据库, 限制为单连接保证所有会话使用同一个库
+func newTestEngine(t *testing.T) *xorm.Engine {
+	engine, err := xorm.NewEngine("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		engine.Close()
+	})
+	return engine
+}
+
+// tableMigration 创建一个建表迁移, 回滚时删除该表
+func tableMigration(version, table string) *Migration {
+	return &Migration{
+		Version: version,
+		Migrate: func(engine *xorm.Engine) error {
+			_, err := engine.Exec(fmt.Sprintf("CREATE TABLE %s (id INTEGER)", table))
+			return err
+		},
+		Rollback: func(engine *xorm.Engine) error {
+			_, err := engine.Exec(fmt.Sprintf("DROP TABLE %s", table))
+			return err
+		},
+	}
+}
+
+func TestFindAndDedupeDuplicateRecords(t *testing.T) {
+	engine := newTestEngine(t)
+	// 迁移表的version有唯一索引, 手动建表模拟被篡改过的迁移表
+	if _, err := engine.Exec("CREATE TABLE migrations (id INTEGER PRIMARY KEY AUTOINCREMENT, version VARCHAR(255) NOT NULL, is_rollback INTEGER DEFAULT 0)"); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range []struct {
+		version    string
+		isRollback int
+	}{
+		{"202307241038_person", 0},
+		{"202307241038_person", 0},
+		{"202307241038_person", 0},
+		{"202307241039_pet", 0},
+		{"202307241039_pet", 1},
+		{"202307241042_person", 0},
+		{"202307241042_person", 0},
+	} {
+		if _, err := engine.Exec("INSERT INTO migrations (version, is_rollback) VALUES (?, ?)", row.version, row.isRollback); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	migrator := New(engine, &Options{}, mi)
+	duplicates, err := migrator.FindDuplicateRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(duplicates) != 2 || duplicates["202307241038_person"] != 3 || duplicates["202307241042_person"] != 2 {
+		t.Fatalf("unexpected duplicates: %v", duplicates)
+	}
+	
+	removed, err := migrator.DedupeRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Fatalf("expected 3 removed records, got %d", removed)
+	}
+	duplicates, err = migrator.FindDuplicateRecords()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(duplicates) != 0 {
+		t.Fatalf("expected no duplicates after dedupe, got %v", duplicates)
+	}
+	ran, err := migrator.migrationRan(&Migration{Version: "202307241038_person"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ran {
+		t.Fatal("expected one record of 202307241038_person to be kept")
+	}
+}
+
+func TestMigrateToExclusive(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	})
+	if err := migrator.MigrateToExclusive("202307241041"); !errors.Is(err, ErrMigrationVersionDoesNotExist) {
+		t.Fatalf("expected ErrMigrationVersionDoesNotExist, got %v", err)
+	}
+	if err := migrator.MigrateToExclusive("202307241040"); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241038 202307241039]" {
+		t.Fatalf("expected migrations before the target to run, got %v", applied)
+	}
+	if exist, _ := engine.IsTableExist("toy"); exist {
+		t.Fatal("expected the target migration not to run")
+	}
+}
+
+func TestPending(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	})
+	pending, err := migrator.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versionsOf(pending)) != "[202307241038 202307241039 202307241040]" {
+		t.Fatalf("unexpected pending migrations before migrating: %v", versionsOf(pending))
+	}
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = migrator.Pending()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versionsOf(pending)) != "[202307241040]" {
+		t.Fatalf("expected rolled back migration to be pending, got %v", versionsOf(pending))
+	}
+}
+
+func TestDowntimeMigrations(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+		tableMigration("202307241040", "c"),
+		tableMigration("202307241041", "d"),
+	}
+	migrations[0].RequiresDowntime = true
+	migrations[2].RequiresDowntime = true
+	migrator := New(engine, &Options{}, migrations)
+	
+	versions, err := migrator.DowntimeMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versions) != "[202307241038 202307241040]" {
+		t.Fatalf("unexpected downtime migrations before migrating: %v", versions)
+	}
+	
+	if err := migrator.MigrateTo("202307241038"); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = migrator.DowntimeMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versions) != "[202307241040]" {
+		t.Fatalf("unexpected downtime migrations after migrating: %v", versions)
+	}
+}
+
+func TestSessionTimezoneSQL(t *testing.T) {
+	tests := []struct {
+		dbType   core.DbType
+		timezone string
+		query    string
+		err      error
+	}{
+		{core.MYSQL, "UTC", "SET time_zone = 'UTC'", nil},
+		{core.MYSQL, "+08:00", "SET time_zone = '+08:00'", nil},
+		{core.POSTGRES, "Asia/Shanghai", "SET TIME ZONE 'Asia/Shanghai'", nil},
+		{core.POSTGRES, "-05:30", "SET TIME ZONE INTERVAL '-05:30' HOUR TO MINUTE", nil},
+		{core.MYSQL, "Mars/Olympus", "", ErrInvalidTimezone},
+		{core.MYSQL, "UTC'; DROP TABLE migrations; --", "", ErrInvalidTimezone},
+		{core.MYSQL, "+25:00", "", ErrInvalidTimezone},
+		{core.SQLITE, "UTC", "", ErrTimezoneNotSupported},
+	}
+	for _, tt := range tests {
+		query, err := sessionTimezoneSQL(tt.dbType, tt.timezone)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("%s %q: expected error %v, got %v", tt.dbType, tt.timezone, tt.err, err)
+		}
+		if query != tt.query {
+			t.Errorf("%s %q: expected %q, got %q", tt.dbType, tt.timezone, tt.query, query)
+		}
+	}
+}
+
+func TestSessionTimezoneAppliedBeforeMigrations(t *testing.T) {
+	engine := newTestEngine(t)
+	ran := false
+	migrator := New(engine, &Options{SessionTimezone: "UTC"}, []*Migration{{
+		Version: "202307241038",
+		Migrate: func(engine *xorm.Engine) error {
+			ran = true
+			return nil
+		},
+	}})
+	// SQLite不支持会话时区, 设置失败时不应该运行任何迁移
+	if err := migrator.Migrate(); !errors.Is(err, ErrTimezoneNotSupported) {
+		t.Fatalf("expected ErrTimezoneNotSupported, got %v", err)
+	}
+	if ran {
+		t.Fatal("migration should not run when the session timezone can't be applied")
+	}
+	
+	// 迁移函数中读取会话时区, 需要MySQL, 例如 XORMIGRATE_MYSQL_DSN="root@tcp(127.0.0.1:3306)/test"
+	dsn := os.Getenv("XORMIGRATE_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("XORMIGRATE_MYSQL_DSN is not set")
+	}
+	mysql, err := xorm.NewEngine("mysql", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mysql.Close()
+	// 只有一个连接, 时区泄漏到应用连接时下面可以读到
+	mysql.SetMaxOpenConns(1)
+	options := &Options{TableName: "xormigrate_timezone_test", SessionTimezone: "+08:00"}
+	defer mysql.Exec("DROP TABLE IF EXISTS " + options.TableName)
+	var inMigration string
+	migrator = New(mysql, options, []*Migration{{
+		Version: "202307241038",
+		Migrate: func(engine *xorm.Engine) error {
+			_, err := engine.SQL("SELECT @@session.time_zone").Get(&inMigration)
+			return err
+		},
+	}})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if inMigration != "+08:00" {
+		t.Fatalf("expected the migration to see the session timezone, got %q", inMigration)
+	}
+	var app string
+	if _, err := mysql.SQL("SELECT @@session.time_zone").Get(&app); err != nil {
+		t.Fatal(err)
+	}
+	if app == "+08:00" {
+		t.Fatal("the session timezone should not leak into application connections")
+	}
+}
+
+func TestNewSessionEngine(t *testing.T) {
+	engine, err := xorm.NewEngine("sqlite3", "file:"+filepath.Join(t.TempDir(), "x.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	session, err := newSessionEngine(engine, "PRAGMA foreign_keys = ON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	// 多个连接都执行了初始化语句
+	session.SetMaxIdleConns(0)
+	for i := 0; i < 2; i++ {
+		var enabled int
+		if _, err := session.SQL("PRAGMA foreign_keys").Get(&enabled); err != nil || enabled != 1 {
+			t.Fatalf("expected every session connection to be initialized, got %d, %v", enabled, err)
+		}
+	}
+	var enabled int
+	if _, err := engine.SQL("PRAGMA foreign_keys").Get(&enabled); err != nil || enabled != 0 {
+		t.Fatalf("the original engine should not be affected, got %d, %v", enabled, err)
+	}
+	if session.GetTZDatabase() != engine.GetTZDatabase() || session.GetTableMapper() != engine.GetTableMapper() {
+		t.Fatal("expected the session engine to keep the engine settings")
+	}
+	
+	// 相同的驱动和语句可以重复使用
+	again, err := newSessionEngine(engine, "PRAGMA foreign_keys = ON")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again.Close()
+}
+
+func TestCheckForeignKeys(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		{
+			Version: "202307241038_owner",
+			Migrate: func(engine *xorm.Engine) error {
+				_, err := engine.Exec("CREATE TABLE owner (id INTEGER PRIMARY KEY)")
+				return err
+			},
+		},
+		{
+			Version: "202307241039_pet",
+			Migrate: func(engine *xorm.Engine) error {
+				if _, err := engine.Exec("CREATE TABLE pet (id INTEGER PRIMARY KEY, owner_id INTEGER REFERENCES owner(id))"); err != nil {
+					return err
+				}
+				// SQLite默认不强制外键, 可以插入孤立数据
+				_, err := engine.Exec("INSERT INTO pet (id, owner_id) VALUES (1, 42)")
+				return err
+			},
+		},
+	}
+	
+	if err := New(engine, &Options{}, migrations).MigrateTo("202307241038_owner"); err != nil {
+		t.Fatal(err)
+	}
+	err := New(engine, &Options{CheckForeignKeys: true}, migrations).Migrate()
+	if !errors.Is(err, ErrForeignKeyViolation) {
+		t.Fatalf("expected ErrForeignKeyViolation, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "pet") {
+		t.Fatalf("expected offending table in error, got %v", err)
+	}
+	// 默认模式下记录写入即生效, 检查在写入记录前进行, 失败的迁移不会被记录
+	if ran, err := New(engine, &Options{}, migrations).HasRun("202307241039_pet"); err != nil || ran {
+		t.Fatalf("expected the failing migration not to be recorded, got %v, %v", ran, err)
+	}
+	
+	// 迁移函数的修改不在事务中, 需要手动清理后重新运行
+	if _, err := engine.Exec("DROP TABLE pet"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Exec("INSERT INTO owner (id) VALUES (42)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := New(engine, &Options{CheckForeignKeys: true}, migrations).Migrate(); err != nil {
+		t.Fatalf("expected no violation once the parent row exists, got %v", err)
+	}
+}
+
+func TestAutoBackupAndRestore(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		{
+			Version: "202307241038_person",
+			Migrate: func(engine *xorm.Engine) error {
+				if _, err := engine.Exec("CREATE TABLE person (name VARCHAR(255))"); err != nil {
+					return err
+				}
+				_, err := engine.Exec("INSERT INTO person (name) VALUES ('a'), ('b')")
+				return err
+			},
+		},
+		{
+			Version:      "202307241039_person",
+			BackupTables: []string{"person"},
+			Migrate: func(engine *xorm.Engine) error {
+				_, err := engine.Exec("DELETE FROM person WHERE name = 'a'")
+				return err
+			},
+		},
+	}
+	migrator := New(engine, &Options{AutoBackup: true}, migrations)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	backup := BackupTableName("person", "202307241039_person")
+	if backup != "person_backup_202307241039_person" {
+		t.Fatalf("unexpected backup table name %s", backup)
+	}
+	count, err := engine.Table(backup).Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected backup to contain 2 rows, got %d", count)
+	}
+	if count, _ := engine.Table("person").Count(); count != 1 {
+		t.Fatalf("expected migration to delete a row, got %d rows", count)
+	}
+	
+	// 备份表名保存在迁移记录中, 代码中的迁移改变后仍然可以恢复
+	stored, err := migrator.storedBackupTables("202307241039_person")
+	if err != nil || stored["person"] != backup {
+		t.Fatalf("expected the backup table to be recorded, got %v, %v", stored, err)
+	}
+	if err := New(engine, &Options{}, migrations[:1]).RestoreBackup("202307241039_person"); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := engine.Table("person").Count(); count != 2 {
+		t.Fatalf("expected restored table to contain 2 rows, got %d", count)
+	}
+	if err := migrator.RestoreBackup("202307241039_person"); !errors.Is(err, ErrNoBackup) {
+		t.Fatalf("expected ErrNoBackup once the backup was restored, got %v", err)
+	}
+	if err := migrator.RestoreBackup("202307241038_person"); !errors.Is(err, ErrNoBackup) {
+		t.Fatalf("expected ErrNoBackup for a migration without BackupTables, got %v", err)
+	}
+}
+
+func TestMissingGrants(t *testing.T) {
+	tests := []struct {
+		name    string
+		grants  []string
+		missing []string
+	}{
+		{
+			name:   "all privileges",
+			grants: []string{"GRANT ALL PRIVILEGES ON *.* TO `root`@`%` WITH GRANT OPTION"},
+		},
+		{
+			name: "database privileges",
+			grants: []string{
+				"GRANT USAGE ON *.* TO `app`@`%`",
+				"GRANT SELECT, INSERT, UPDATE, CREATE, ALTER ON `app`.* TO `app`@`%`",
+			},
+		},
+		{
+			name: "restricted user",
+			grants: []string{
+				"GRANT USAGE ON *.* TO `readonly`@`%`",
+				"GRANT SELECT, INSERT, UPDATE ON `app`.* TO `readonly`@`%`",
+				"GRANT CREATE, ALTER ON `other`.* TO `readonly`@`%`",
+			},
+			missing: []string{"CREATE", "ALTER"},
+		},
+	}
+	for _, tt := range tests {
+		if got := missingGrants(tt.grants, "app"); fmt.Sprint(got) != fmt.Sprint(tt.missing) {
+			t.Errorf("%s: expected missing %v, got %v", tt.name, tt.missing, got)
+		}
+	}
+}
+
+func TestCheckPrivilegesFirst(t *testing.T) {
+	engine := newTestEngine(t)
+	// SQLite没有权限系统, 检查直接通过
+	migrator := New(engine, &Options{CheckPrivilegesFirst: true}, []*Migration{tableMigration("202307241038", "a")})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateAsDeploy(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+		tableMigration("202307241040", "c"),
+	}
+	if err := New(engine, &Options{}, migrations[:2]).MigrateAs("deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.MigrateAs("deploy-2"); err != nil {
+		t.Fatal(err)
+	}
+	
+	versions, err := migrator.MigrationsForDeploy("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versions) != "[202307241038 202307241039]" {
+		t.Fatalf("unexpected migrations for deploy-1: %v", versions)
+	}
+	versions, err = migrator.MigrationsForDeploy("deploy-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versions) != "[202307241040]" {
+		t.Fatalf("unexpected migrations for deploy-2: %v", versions)
+	}
+	versions, err = migrator.MigrationsForDeploy("deploy-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Fatalf("expected no migrations for deploy-3, got %v", versions)
+	}
+}
+
+func TestMigrationTableUpgrade(t *testing.T) {
+	engine := newTestEngine(t)
+	// 旧版本创建的迁移表没有deploy_id列
+	if _, err := engine.Exec("CREATE TABLE migrations (id INTEGER PRIMARY KEY AUTOINCREMENT, version VARCHAR(255) NOT NULL, is_rollback INTEGER DEFAULT 0)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Exec("INSERT INTO migrations (version) VALUES ('202307241038')"); err != nil {
+		t.Fatal(err)
+	}
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+	})
+	if err := migrator.MigrateAs("deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := migrator.MigrationsForDeploy("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versions) != "[202307241039]" {
+		t.Fatalf("unexpected migrations for deploy-1: %v", versions)
+	}
+}
+
+func TestRollbackDeploy(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+		tableMigration("202307241040", "c"),
+		tableMigration("202307241041", "d"),
+	}
+	if err := New(engine, &Options{}, migrations[:2]).MigrateAs("deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.MigrateAs("deploy-2"); err != nil {
+		t.Fatal(err)
+	}
+	
+	if err := migrator.RollbackDeploy("deploy-2"); err != nil {
+		t.Fatal(err)
+	}
+	for table, want := range map[string]bool{"a": true, "b": true, "c": false, "d": false} {
+		exist, err := engine.IsTableExist(table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exist != want {
+			t.Errorf("table %s: expected exist=%v, got %v", table, want, exist)
+		}
+	}
+	versions, err := migrator.MigrationsForDeploy("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versions) != "[202307241038 202307241039]" {
+		t.Fatalf("deploy-1 should be untouched, got %v", versions)
+	}
+	versions, err = migrator.MigrationsForDeploy("deploy-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Fatalf("expected deploy-2 to be rolled back, got %v", versions)
+	}
+}
+
+func TestRollbackDeployAtomic(t *testing.T) {
+	engine := newTestEngine(t)
+	if _, err := engine.Exec("CREATE TABLE person (name varchar(255))"); err != nil {
+		t.Fatal(err)
+	}
+	fail := errors.New("boom")
+	seed := func(version, name string) *Migration {
+		return &Migration{
+			Version: version,
+			MigrateTx: func(tx *xorm.Session) error {
+				_, err := tx.Exec("INSERT INTO person (name) VALUES (?)", name)
+				return err
+			},
+			RollbackTx: func(tx *xorm.Session) error {
+				_, err := tx.Exec("DELETE FROM person WHERE name = ?", name)
+				return err
+			},
+		}
+	}
+	migrations := []*Migration{seed("202307241038", "alice"), seed("202307241039", "bob"), seed("202307241040", "carol")}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.MigrateAs("deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	
+	// 逆序回滚时第二个迁移失败, 第一个迁移的回滚和记录都被撤销
+	migrations[1].RollbackTx = func(*xorm.Session) error { return fail }
+	if err := migrator.RollbackDeploy("deploy-1"); !errors.Is(err, fail) {
+		t.Fatalf("expected rollback error, got %v", err)
+	}
+	if count, err := engine.Table("person").Count(); err != nil || count != 3 {
+		t.Fatalf("expected no row to be removed, got %d, %v", count, err)
+	}
+	versions, err := migrator.MigrationsForDeploy("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(versions) != "[202307241038 202307241039 202307241040]" {
+		t.Fatalf("expected deploy-1 to stay applied, got %v", versions)
+	}
+}
+
+func TestRollbackDeployIrreversible(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+	}
+	migrations[0].Rollback = nil
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.MigrateAs("deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	
+	err := migrator.RollbackDeploy("deploy-1")
+	if !errors.Is(err, ErrRollbackImpossible) || !strings.Contains(err.Error(), "202307241038") {
+		t.Fatalf("expected ErrRollbackImpossible naming 202307241038, got %v", err)
+	}
+	// 不可回滚时整个发布都不应该被回滚
+	if exist, _ := engine.IsTableExist("b"); !exist {
+		t.Fatal("expected table b to be kept")
+	}
+}
+
+func TestUnknownMigrationStrategy(t *testing.T) {
+	migrations := []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+	}
+	// 另一个分支运行过202307241039, 当前代码中只有202307241038和202307241040
+	declared := []*Migration{
+		migrations[0],
+		tableMigration("202307241040", "c"),
+	}
+	tests := []struct {
+		name     string
+		options  *Options
+		err      error
+		recorded bool
+	}{
+		{"fail", &Options{ValidateUnknownMigrations: true}, ErrUnknownPastMigration, true},
+		{"warn", &Options{ValidateUnknownMigrations: true, UnknownMigrationStrategy: UnknownMigrationWarn}, nil, true},
+		{"treat as applied", &Options{ValidateUnknownMigrations: true, UnknownMigrationStrategy: UnknownMigrationTreatAsApplied}, nil, true},
+		{"remove without confirm", &Options{ValidateUnknownMigrations: true, UnknownMigrationStrategy: UnknownMigrationRemove}, ErrRemoveUnknownNotConfirmed, true},
+		{"remove", &Options{ValidateUnknownMigrations: true, UnknownMigrationStrategy: UnknownMigrationRemove, ConfirmRemoveUnknownMigrations: true}, nil, false},
+	}
+	for _, tt := range tests {
+		engine := newTestEngine(t)
+		if err := New(engine, &Options{}, migrations).Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		migrator := New(engine, tt.options, declared)
+		if err := migrator.Migrate(); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected error %v, got %v", tt.name, tt.err, err)
+		}
+		ran, err := migrator.migrationRan(migrations[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ran != tt.recorded {
+			t.Errorf("%s: expected orphan record kept=%v, got %v", tt.name, tt.recorded, ran)
+		}
+		ran, err = migrator.migrationRan(declared[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ran != (tt.err == nil) {
+			t.Errorf("%s: expected 202307241040 applied=%v, got %v", tt.name, tt.err == nil, ran)
+		}
+	}
+	
+	// 另一个分支回滚过202307241039, 视为已运行时重新记录为已运行, 只警告时保持回滚
+	for strategy, applied := range map[UnknownMigrationStrategy]bool{UnknownMigrationWarn: false, UnknownMigrationTreatAsApplied: true} {
+		engine := newTestEngine(t)
+		seeded := New(engine, &Options{}, migrations)
+		if err := seeded.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := seeded.RollbackLast(); err != nil {
+			t.Fatal(err)
+		}
+		migrator := New(engine, &Options{ValidateUnknownMigrations: true, UnknownMigrationStrategy: strategy}, declared)
+		if err := migrator.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+		ran, err := migrator.migrationRan(migrations[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ran != applied {
+			t.Errorf("strategy %d: expected rolled back orphan applied=%v, got %v", strategy, applied, ran)
+		}
+	}
+}
+
+func TestUnknownMigrations(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+		tableMigration("202307241040", "c"),
+	}
+	migrator := New(engine, &Options{ValidateUnknownMigrations: true}, migrations[2:])
+	if unknown, err := migrator.UnknownMigrations(); err != nil || unknown != nil {
+		t.Fatalf("expected no unknown migrations without the table, got %v, %v", unknown, err)
+	}
+	
+	if err := New(engine, &Options{}, migrations).MigrateTo("202307241039"); err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := migrator.UnknownMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(unknown) != "[202307241038 202307241039]" {
+		t.Fatalf("unexpected unknown migrations: %v", unknown)
+	}
+	err = migrator.Migrate()
+	if !errors.Is(err, ErrUnknownPastMigration) || !strings.Contains(err.Error(), "202307241038, 202307241039") {
+		t.Fatalf("expected ErrUnknownPastMigration listing the versions, got %v", err)
+	}
+}
+
+func TestInitSchemaSQLProgress(t *testing.T) {
+	engine := newTestEngine(t)
+	var progress []string
+	options := &Options{
+		InitSchemaSQL: []string{
+			"CREATE TABLE person (name VARCHAR(255))",
+			"CREATE TABLE pet (name VARCHAR(255))",
+			"CREATE TABLE broken (",
+			"CREATE INDEX idx_pet_name ON pet (name)",
+		},
+		InitSchemaProgress: func(done, total int) {
+			progress = append(progress, fmt.Sprintf("%d/%d", done, total))
+		},
+	}
+	migrator := New(engine, options, []*Migration{tableMigration("202307241038", "a")})
+	if err := migrator.Migrate(); err == nil || !strings.Contains(err.Error(), "3/4") {
+		t.Fatalf("expected the third statement to fail, got %v", err)
+	}
+	if fmt.Sprint(progress) != "[1/4 2/4]" {
+		t.Fatalf("unexpected progress: %v", progress)
+	}
+	
+	// 修复语句后重新运行, 从第三条语句继续
+	progress = nil
+	options.InitSchemaSQL[2] = "CREATE TABLE fixed (id INTEGER)"
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(progress) != "[3/4 4/4]" {
+		t.Fatalf("unexpected progress after resume: %v", progress)
+	}
+	for _, version := range []string{initSchemaMigrationVersion, "202307241038"} {
+		ran, err := migrator.migrationRan(&Migration{Version: version})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ran {
+			t.Fatalf("expected %s to be recorded", version)
+		}
+	}
+	count, err := engine.Table("migrations").Where("version LIKE ?", initSchemaProgressPrefix+"%").Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatal("expected progress record to be removed after init")
+	}
+	// 初始化时不会运行迁移函数, 只记录为已运行
+	if exist, _ := engine.IsTableExist("a"); exist {
+		t.Fatal("migration should not run after init schema")
+	}
+}
+
+func TestGenerateNextMigration(t *testing.T) {
+	engine := newTestEngine(t)
+	if _, err := engine.Exec("CREATE TABLE person (name VARCHAR(255))"); err != nil {
+		t.Fatal(err)
+	}
+	type Person struct {
+		Name string
+		Age  int
+	}
+	migration, err := GenerateNextMigration(engine, new(Person))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migration.Description != "add column person.age" {
+		t.Fatalf("unexpected changes: %s", migration.Description)
+	}
+	
+	migrator := New(engine, DefaultOptions, []*Migration{migration})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	assertColumns(t, engine, "person", "name,age")
+	if _, err := GenerateNextMigration(engine, new(Person)); !errors.Is(err, ErrNoSchemaChanges) {
+		t.Fatalf("expected ErrNoSchemaChanges, got %v", err)
+	}
+	
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	assertColumns(t, engine, "person", "name")
+}
+
+func TestCaptureSource(t *testing.T) {
+	engine := newTestEngine(t)
+	options := &Options{CaptureSource: true}
+	migrator := New(engine, options, []*Migration{
+		{
+			Version: "202307241038_person",
+			Migrate: func(tx *xorm.Engine) error {
+				_, err := tx.Exec("ALTER TABLE missing ADD COLUMN name VARCHAR(255)")
+				return err
+			},
+		},
+	})
+	err := migrator.Migrate()
+	if err == nil {
+		t.Fatal("expected migration to fail")
+	}
+	if !strings.Contains(err.Error(), "migration 202307241038_person defined at migrate_test.go:") {
+		t.Fatalf("expected source in error, got %v", err)
+	}
+}
+
+func TestOnChecksumMismatch(t *testing.T) {
+	engine := newTestEngine(t)
+	runs := 0
+	person := &Migration{
+		Version:  "202307241038_person",
+		Checksum: "v1",
+		Migrate: func(tx *xorm.Engine) error {
+			runs++
+			return nil
+		},
+	}
+	if err := New(engine, &Options{}, []*Migration{person}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	person.Checksum = "v2"
+	migrations := []*Migration{person, tableMigration("202307241039", "pet")}
+	if err := New(engine, &Options{}, migrations).Migrate(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	
+	var mismatch string
+	options := &Options{
+		OnChecksumMismatch: func(version, dbChecksum, codeChecksum string) (ChecksumAction, error) {
+			mismatch = fmt.Sprintf("%s %s->%s", version, dbChecksum, codeChecksum)
+			return ChecksumIgnore, nil
+		},
+	}
+	if err := New(engine, options, migrations).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if mismatch != "202307241038_person v1->v2" {
+		t.Fatalf("unexpected mismatch: %s", mismatch)
+	}
+	if runs != 1 {
+		t.Fatalf("ignored migration should not run again, ran %d times", runs)
+	}
+	if exist, _ := engine.IsTableExist("pet"); !exist {
+		t.Fatal("expected migration after the mismatch to run")
+	}
+}
+
+func TestMigrateContextCancelled(t *testing.T) {
+	engine := newTestEngine(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	person := tableMigration("202307241038", "person")
+	migrate := person.Migrate
+	person.Migrate = func(tx *xorm.Engine) error {
+		cancel()
+		return migrate(tx)
+	}
+	migrator := New(engine, &Options{}, []*Migration{
+		person,
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	})
+	err := migrator.MigrateContext(ctx)
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) {
+		t.Fatalf("expected CancelledError, got %v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", cancelled.Err)
+	}
+	// ctx取消后记录迁移的语句也会中止, 该迁移算作中断
+	if len(cancelled.Completed) != 0 || cancelled.Interrupted != "202307241038" {
+		t.Fatalf("unexpected cancellation state: %+v", cancelled)
+	}
+	if exist, _ := engine.IsTableExist("pet"); exist {
+		t.Fatal("migration after cancellation should not run")
+	}
+}
+
+func TestMigrateContextCancelledLocked(t *testing.T) {
+	engine, err := xorm.NewEngine("sqlite3", "file:"+filepath.Join(t.TempDir(), "x.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		engine.Close()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	table := func(version, name string) *Migration {
+		return &Migration{
+			Version: version,
+			MigrateTx: func(tx *xorm.Session) error {
+				_, err := tx.Exec(fmt.Sprintf("CREATE TABLE %s (id INTEGER)", name))
+				return err
+			},
+		}
+	}
+	pet := table("202307241039", "pet")
+	pet.MigrateTx = func(*xorm.Session) error {
+		cancel()
+		return nil
+	}
+	migrator := New(engine, &Options{LockMigrationsTable: true}, []*Migration{table("202307241038", "person"), pet})
+	err = migrator.MigrateContext(ctx)
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) {
+		t.Fatalf("expected CancelledError, got %v", err)
+	}
+	// 取消时整个事务回滚, 第一个迁移虽然已经完成也没有被保存
+	if len(cancelled.Completed) != 0 || cancelled.Interrupted != "202307241039" {
+		t.Fatalf("unexpected cancellation state: %+v", cancelled)
+	}
+	if ran, err := migrator.HasRun("202307241038"); err != nil || ran {
+		t.Fatalf("expected 202307241038 not to be recorded, got %v, %v", ran, err)
+	}
+}
+
+func TestRollbackContextCancelled(t *testing.T) {
+	engine := newTestEngine(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	
+	toy := tableMigration("202307241040", "toy")
+	rollback := toy.Rollback
+	toy.Rollback = func(tx *xorm.Engine) error {
+		cancel()
+		return rollback(tx)
+	}
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		toy,
+	})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	err := migrator.RollbackToContext(ctx, "202307241038")
+	var cancelled *CancelledError
+	if !errors.As(err, &cancelled) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected CancelledError, got %v", err)
+	}
+	if fmt.Sprint(cancelled.Completed) != "[202307241040]" {
+		t.Fatalf("unexpected cancellation state: %+v", cancelled)
+	}
+	if exist, _ := engine.IsTableExist("pet"); !exist {
+		t.Fatal("rollback after cancellation should not run")
+	}
+	applied, err := migrator.appliedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241038 202307241039]" {
+		t.Fatalf("expected completed rollback to be recorded, got %v", applied)
+	}
+	
+	if err := migrator.RollbackLastContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("pet"); !exist {
+		t.Fatal("rollback with a cancelled context should not run")
+	}
+}
+
+func TestManifestHash(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{tableMigration("202307241038", "person"), tableMigration("202307241039", "pet")}
+	hash := New(engine, &Options{}, migrations).ManifestHash()
+	if len(hash) != 64 {
+		t.Fatalf("unexpected hash: %s", hash)
+	}
+	if got := New(engine, &Options{}, migrations).ManifestHash(); got != hash {
+		t.Fatalf("hash is not stable: %s != %s", got, hash)
+	}
+	
+	added := append(migrations, tableMigration("202307241040", "toy"))
+	if New(engine, &Options{}, added).ManifestHash() == hash {
+		t.Fatal("expected hash to change when a migration is added")
+	}
+	reordered := []*Migration{migrations[1], migrations[0]}
+	if New(engine, &Options{}, reordered).ManifestHash() == hash {
+		t.Fatal("expected hash to change when migrations are reordered")
+	}
+}
+
+func TestRollbackFloor(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{RollbackFloor: "202307241039"}, []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	// 越过floor时不会回滚任何迁移
+	err := migrator.RollbackTo("202307241038")
+	if !errors.Is(err, ErrRollbackFloorReached) || !strings.Contains(err.Error(), "202307241039") {
+		t.Fatalf("expected ErrRollbackFloorReached naming the floor, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("toy"); !exist {
+		t.Fatal("expected no rollback when the floor would be crossed")
+	}
+	
+	if err := migrator.RollbackTo("202307241039"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); !errors.Is(err, ErrRollbackFloorReached) {
+		t.Fatalf("expected ErrRollbackFloorReached, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("pet"); !exist {
+		t.Fatal("expected the floor migration to be kept")
+	}
+	
+	// 数字version按数值比较, 10在floor 9之后
+	migrator = New(newTestEngine(t), &Options{RollbackFloor: "9"}, []*Migration{
+		tableMigration("8", "person"),
+		tableMigration("9", "pet"),
+		tableMigration("10", "toy"),
+	})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatalf("expected 10 to be above the floor, got %v", err)
+	}
+	if err := migrator.RollbackLast(); !errors.Is(err, ErrRollbackFloorReached) {
+		t.Fatalf("expected ErrRollbackFloorReached, got %v", err)
+	}
+}
+
+func TestRollbackPlan(t *testing.T) {
+	engine := newTestEngine(t)
+	irreversible := tableMigration("202307241040", "toy")
+	irreversible.Rollback = nil
+	migrations := []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		irreversible,
+		tableMigration("202307241041", "food"),
+		tableMigration("202307241042", "house"),
+	}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.MigrateTo("202307241041"); err != nil {
+		t.Fatal(err)
+	}
+	
+	plan, err := migrator.RollbackPlan("202307241040")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(plan) != "[202307241041]" {
+		t.Fatalf("unexpected plan: %v", plan)
+	}
+	
+	plan, err = migrator.RollbackPlan("202307241038")
+	if !errors.Is(err, ErrRollbackImpossible) || !strings.Contains(err.Error(), "202307241040") {
+		t.Fatalf("expected irreversible migration to block the plan, got %v", err)
+	}
+	if fmt.Sprint(plan) != "[202307241041 202307241040 202307241039]" {
+		t.Fatalf("unexpected plan: %v", plan)
+	}
+	if exist, _ := engine.IsTableExist("food"); !exist {
+		t.Fatal("RollbackPlan should not roll back anything")
+	}
+}
+
+func TestRecordAffectedRows(t *testing.T) {
+	engine := newTestEngine(t)
+	if _, err := engine.Exec("CREATE TABLE person (name VARCHAR(255))"); err != nil {
+		t.Fatal(err)
+	}
+	migrator := New(engine, &Options{RecordAffectedRows: true}, []*Migration{
+		{
+			Version:        "202307241038_person",
+			AffectedTables: []string{"person"},
+			Migrate: func(tx *xorm.Engine) error {
+				_, err := tx.Exec("INSERT INTO person (name) VALUES ('a'), ('b'), ('c')")
+				return err
+			},
+		},
+	})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := engine.QueryString("SELECT affected_rows FROM migrations WHERE version = '202307241038_person'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["affected_rows"] != "3" {
+		t.Fatalf("expected 3 affected rows, got %v", rows)
+	}
+}
+
+func TestInterMigrationDelay(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{InterMigrationDelay: time.Second}, []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	})
+	var waits []time.Duration
+	migrator.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return nil
+	}
+	if err := migrator.MigrateTo("202307241039"); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(waits) != "[1s]" {
+		t.Fatalf("expected one wait between two migrations, got %v", waits)
+	}
+	
+	// 已运行的迁移不算在内, 本次只运行一个迁移时不等待
+	waits = nil
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if len(waits) != 0 {
+		t.Fatalf("expected no wait, got %v", waits)
+	}
+}
+
+func TestTableExistsFunc(t *testing.T) {
+	engine := newTestEngine(t)
+	var checked []string
+	options := &Options{
+		TableExistsFunc: func(engine *xorm.Engine, table string) (bool, error) {
+			checked = append(checked, table)
+			rows, err := engine.QueryString("SELECT name FROM sqlite_master WHERE type = 'table' AND name = ?", table)
+			return len(rows) > 0, err
+		},
+	}
+	migrator := New(engine, options, []*Migration{tableMigration("202307241038", "person")})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	migrator = New(engine, options, []*Migration{tableMigration("202307241038", "person"), tableMigration("202307241039", "pet")})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(checked) != "[migrations migrations]" {
+		t.Fatalf("expected custom existence check to be used, got %v", checked)
+	}
+	if exist, _ := engine.IsTableExist("pet"); !exist {
+		t.Fatal("expected pet table to be created")
+	}
+}
+
+func TestLockMigrationsTable(t *testing.T) {
+	// 两个迁移器需要使用不同的连接访问同一个数据库
+	dsn := "file:" + filepath.Join(t.TempDir(), "lock.db") + "?_busy_timeout=5000"
+	started := make(chan struct{})
+	release := make(chan struct{})
+	runs := 0
+	migrations := []*Migration{
+		{
+			Version: "202307241038",
+			Migrate: func(tx *xorm.Engine) error {
+				runs++
+				close(started)
+				<-release
+				return nil
+			},
+		},
+	}
+	
+	newMigrator := func() *XorMigrate {
+		engine, err := xorm.NewEngine("sqlite3", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			engine.Close()
+		})
+		return New(engine, &Options{LockMigrationsTable: true}, migrations)
+	}
+	first, second := newMigrator(), newMigrator()
+	
+	firstDone := make(chan error, 1)
+	go func() {
+		firstDone <- first.Migrate()
+	}()
+	<-started
+	
+	secondDone := make(chan error, 1)
+	go func() {
+		secondDone <- second.Migrate()
+	}()
+	select {
+	case err := <-secondDone:
+		t.Fatalf("second migrator should wait for the lock, returned %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+	
+	close(release)
+	if err := <-firstDone; err != nil {
+		t.Fatal(err)
+	}
+	if err := <-secondDone; err != nil {
+		t.Fatal(err)
+	}
+	if runs != 1 {
+		t.Fatalf("expected migration to run once, ran %d times", runs)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	engine := newTestEngine(t)
+	old := tableMigration("202307241037", "old")
+	old.Description = "create old"
+	if err := New(engine, &Options{}, []*Migration{old}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	person := tableMigration("202307241038", "person")
+	person.Description = "create person"
+	pet := tableMigration("202307241039", "pet")
+	pet.Description = "create pet"
+	toy := tableMigration("202307241040", "toy")
+	migrator := New(engine, &Options{}, []*Migration{old, person, toy})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	
+	report, err := New(engine, &Options{}, []*Migration{person, pet, toy}).Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Applied) != 1 || report.Applied[0].Version != "202307241038" || report.Applied[0].Description != "create person" ||
+		report.Applied[0].MigratedAt.IsZero() || !report.Applied[0].RolledBackAt.IsZero() {
+		t.Fatalf("unexpected applied: %+v", report.Applied)
+	}
+	if len(report.Pending) != 2 || report.Pending[0].Version != "202307241039" || !report.Pending[0].MigratedAt.IsZero() {
+		t.Fatalf("unexpected pending: %+v", report.Pending)
+	}
+	// 运行后又回滚的迁移保留上次运行和回滚的时间
+	if rolledBack := report.Pending[1]; rolledBack.Version != "202307241040" || rolledBack.MigratedAt.IsZero() || rolledBack.RolledBackAt.IsZero() {
+		t.Fatalf("expected timestamps for the rolled back migration, got %+v", rolledBack)
+	}
+	// 代码中没有定义的迁移使用迁移表中的描述
+	if len(report.Unknown) != 1 || report.Unknown[0].Version != "202307241037" || report.Unknown[0].Description != "create old" ||
+		report.Unknown[0].MigratedAt.IsZero() {
+		t.Fatalf("unexpected unknown: %+v", report.Unknown)
+	}
+}
+
+func TestPrintPlan(t *testing.T) {
+	engine := newTestEngine(t)
+	old := tableMigration("202307241037", "old")
+	person := tableMigration("202307241038", "person")
+	person.Description = "create person"
+	if err := New(engine, &Options{}, []*Migration{old, person}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	pet := tableMigration("202307241039", "pet")
+	pet.Description = "create pet and backfill owners from the legacy person table"
+	var buf bytes.Buffer
+	if err := New(engine, &Options{}, []*Migration{person, pet}).PrintPlan(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `VERSION       DESCRIPTION                                         STATUS
+202307241038  create person                                       SKIP
+202307241039  create pet and backfill owners from the legacy ...  APPLY
+202307241037                                                      ORPHAN
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected plan:\n%s", buf.String())
+	}
+}
+
+func TestMigrationTimestamps(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{}, []*Migration{tableMigration("202307241038", "person")})
+	timestamps := func() map[string]string {
+		rows, err := engine.Table(DefaultOptions.TableName).Cols("migrated_at", "rolled_back_at").QueryString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 {
+			t.Fatalf("expected one migration record, got %d", len(rows))
+		}
+		return rows[0]
+	}
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if row := timestamps(); row["migrated_at"] == "" || row["rolled_back_at"] != "" {
+		t.Fatalf("unexpected timestamps after migrate: %v", row)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	if row := timestamps(); row["rolled_back_at"] == "" {
+		t.Fatalf("expected rolled_back_at after rollback: %v", row)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if row := timestamps(); row["migrated_at"] == "" || row["rolled_back_at"] != "" {
+		t.Fatalf("expected rolled_back_at to be cleared after migrating again: %v", row)
+	}
+}
+
+func TestMigrationDescription(t *testing.T) {
+	descriptions := func(engine *xorm.Engine) string {
+		rows, err := engine.Table(DefaultOptions.TableName).Cols("version", "description").Asc("id").QueryString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, row := range rows {
+			got = append(got, row["version"]+"="+row["description"])
+		}
+		return strings.Join(got, ",")
+	}
+	person := tableMigration("202307241038", "person")
+	person.Description = "create person"
+	pet := tableMigration("202307241039", "pet")
+	pet.Description = strings.Repeat("x", 300)
+	
+	engine := newTestEngine(t)
+	if err := New(engine, &Options{}, []*Migration{person, pet}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := descriptions(engine); got != "202307241038=create person,202307241039="+strings.Repeat("x", 252)+"..." {
+		t.Fatalf("unexpected descriptions: %s", got)
+	}
+	
+	engine = newTestEngine(t)
+	migrator := New(engine, &Options{}, []*Migration{person})
+	migrator.InitSchema(func(*xorm.Engine) error { return nil })
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := descriptions(engine); got != "SCHEMA_INIT=,202307241038=create person" {
+		t.Fatalf("unexpected descriptions after init schema: %s", got)
+	}
+}
+
+func TestAppliedMigrations(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{TableName: "schema_versions", VersionColumnName: "name"}, []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	})
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if applied == nil || len(applied) != 0 {
+		t.Fatalf("expected an empty slice without migrations table, got %#v", applied)
+	}
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err = migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241038 202307241039]" {
+		t.Fatalf("unexpected applied migrations: %v", applied)
+	}
+}
+
+func TestSchemaAt(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{SnapshotSchema: true}, []*Migration{
+		tableMigration("202307241038", "person"),
+		{
+			Version: "202307241039",
+			Migrate: func(tx *xorm.Engine) error {
+				_, err := tx.Exec("ALTER TABLE person ADD COLUMN name varchar(255)")
+				return err
+			},
+		},
+		{
+			Version: "202307241040",
+			Migrate: func(tx *xorm.Engine) error {
+				_, err := tx.Exec("INSERT INTO person (id, name) VALUES (1, 'a')")
+				return err
+			},
+		},
+	})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := migrator.SchemaAt("202307241038")
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := migrator.SchemaAt("202307241039")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatal("expected adding a column to change the schema fingerprint")
+	}
+	if data, _ := migrator.SchemaAt("202307241040"); data != after {
+		t.Fatal("expected a data migration to keep the schema fingerprint")
+	}
+	if _, err := migrator.SchemaAt("202307241041"); !errors.Is(err, ErrNoSchemaSnapshot) {
+		t.Fatalf("expected ErrNoSchemaSnapshot, got %v", err)
+	}
+}
+
+func TestTableStats(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	})
+	stats, err := migrator.TableStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (TableStats{}) {
+		t.Fatalf("expected zeroed stats without migrations table, got %+v", stats)
+	}
+	
+	start := time.Now().Truncate(time.Second)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = migrator.TableStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.TotalRows != 3 || stats.RolledBackRows != 1 || stats.CurrentVersion != "202307241039" {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	if stats.OldestAppliedAt.Before(start) || stats.NewestAppliedAt.Before(stats.OldestAppliedAt) || stats.NewestAppliedAt.After(time.Now()) {
+		t.Fatalf("unexpected applied times %s - %s", stats.OldestAppliedAt, stats.NewestAppliedAt)
+	}
+}
+
+func TestTrustInitSchemaMarkers(t *testing.T) {
+	engine := newTestEngine(t)
+	initSchema := func(tx *xorm.Engine) error {
+		_, err := tx.Exec("CREATE TABLE person (id INTEGER)")
+		return err
+	}
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202307241038", "a"),
+		tableMigration("202307241039", "b"),
+		tableMigration("202307241040", "c"),
+	})
+	migrator.InitSchema(initSchema)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	// 合并前两个迁移后代码中只剩下202307241040
+	squashed := []*Migration{tableMigration("202307241040", "c"), tableMigration("202307241041", "d")}
+	options := &Options{ValidateUnknownMigrations: true}
+	migrator = New(engine, options, squashed)
+	migrator.InitSchema(initSchema)
+	if err := migrator.Migrate(); !errors.Is(err, ErrUnknownPastMigration) {
+		t.Fatalf("expected ErrUnknownPastMigration, got %v", err)
+	}
+	
+	options.TrustInitSchemaMarkers = true
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := engine.IsTableExist("d"); !exist {
+		t.Fatal("expected migration after the squash point to run")
+	}
+}
+
+func TestExportSQL(t *testing.T) {
+	engine := newTestEngine(t)
+	pet := tableMigration("202307241039_it's", "pet")
+	pet.RollbackSQL = []string{`DROP TABLE "pet"`}
+	migrations := []*Migration{tableMigration("202307241038", "person"), pet, tableMigration("202307241040", "toy")}
+	options := &Options{StoreRollbackSQL: true}
+	migrator := New(engine, options, migrations)
+	if err := migrator.MigrateAs("deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackMigration(migrations[2]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Exec("INSERT INTO migrations (version) VALUES (?)", lockMigrationVersion); err != nil {
+		t.Fatal(err)
+	}
+	var buf strings.Builder
+	if err := migrator.ExportSQL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := buf.String()
+	lines := strings.Split(strings.TrimSpace(exported), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "INSERT INTO `migrations` (") {
+		t.Fatalf("unexpected export:\n%s", exported)
+	}
+	if strings.Contains(exported, lockMigrationVersion) {
+		t.Fatalf("internal records should not be exported:\n%s", exported)
+	}
+	if !strings.Contains(exported, "NULL") || regexp.MustCompile(`\d{4}-\d{2}-\d{2}T`).MatchString(exported) {
+		t.Fatalf("expected NULLs and database datetimes:\n%s", exported)
+	}
+	
+	// 重新导入后记录与原数据库一致
+	target := newTestEngine(t)
+	if err := target.Table("migrations").Sync2(migrator.model()); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		if _, err := target.Exec(line); err != nil {
+			t.Fatalf("%s: %v", line, err)
+		}
+	}
+	imported := New(target, options, migrations)
+	buf.Reset()
+	if err := imported.ExportSQL(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != exported {
+		t.Fatalf("re-exported records differ:\n%s\nexpected:\n%s", buf.String(), exported)
+	}
+	deployed, err := imported.MigrationsForDeploy("deploy-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(deployed) != "[202307241038 202307241039_it's]" {
+		t.Fatalf("unexpected imported migrations: %v", deployed)
+	}
+	statuses, err := imported.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[1].Applied || !statuses[2].RolledBack {
+		t.Fatalf("unexpected imported status: %+v", statuses)
+	}
+	if _, err := target.Exec("CREATE TABLE pet (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := imported.RollbackStored(pet.Version); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := target.IsTableExist("pet"); exist {
+		t.Fatal("expected the imported rollback SQL to drop pet")
+	}
+}
+
+func TestQuoteSQLString(t *testing.T) {
+	if quoted := quoteSQLString(core.MYSQL, `it's a\b`); quoted != `'it''s a\\b'` {
+		t.Fatalf("unexpected MySQL string: %s", quoted)
+	}
+	if quoted := quoteSQLString(core.SQLITE, `it's a\b`); quoted != `'it''s a\b'` {
+		t.Fatalf("unexpected SQLite string: %s", quoted)
+	}
+}
+
+func TestCanInitializeSchema(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{tableMigration("202401010000", "pet")}
+	options := &Options{InitSchemaTables: []string{"person"}}
+	migrator := New(engine, options, migrations)
+	if can, err := migrator.CanInitializeSchema(); err != nil || can {
+		t.Fatalf("expected false without InitSchema, got %v, %v", can, err)
+	}
+	migrator.InitSchema(func(engine *xorm.Engine) error {
+		_, err := engine.Exec("CREATE TABLE person (id INTEGER)")
+		return err
+	})
+	if can, err := migrator.CanInitializeSchema(); err != nil || !can {
+		t.Fatalf("expected true on an empty database, got %v, %v", can, err)
+	}
+	
+	// 已有表的项目添加InitSchema时不会重复建表
+	if _, err := engine.Exec("CREATE TABLE person (id INTEGER)"); err != nil {
+		t.Fatal(err)
+	}
+	if can, err := migrator.CanInitializeSchema(); !errors.Is(err, ErrInitSchemaTablesExist) || can {
+		t.Fatalf("expected ErrInitSchemaTablesExist, got %v, %v", can, err)
+	}
+	err := migrator.Migrate()
+	if !errors.Is(err, ErrInitSchemaTablesExist) || !strings.Contains(err.Error(), "person") {
+		t.Fatalf("expected ErrInitSchemaTablesExist naming person, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("pet"); exist {
+		t.Fatal("no migration should run")
+	}
+	
+	if _, err := engine.Exec("DROP TABLE person"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if can, err := migrator.CanInitializeSchema(); err != nil || can {
+		t.Fatalf("expected false after initialization, got %v, %v", can, err)
+	}
+}
+
+func TestInitSchemaRecordsAllOrNothing(t *testing.T) {
+	engine := newTestEngine(t)
+	initSchema := func(tx *xorm.Engine) error {
+		_, err := tx.Exec("CREATE TABLE IF NOT EXISTS person (id INTEGER)")
+		return err
+	}
+	
+	// version超过VersionColumnSize时InitSchema不会运行
+	migrator := New(engine, &Options{VersionColumnSize: 8}, []*Migration{
+		{Version: "20230724", Migrate: func(*xorm.Engine) error { return nil }},
+		{Version: "202307241042", Migrate: func(*xorm.Engine) error { return nil }},
+	})
+	migrator.InitSchema(initSchema)
+	if err := migrator.Migrate(); !errors.Is(err, ErrVersionTooLong) {
+		t.Fatalf("expected ErrVersionTooLong, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("expected init schema not to run")
+	}
+	
+	// 数据库拒绝其中一条记录时, 已经写入的记录也会回滚
+	engine = newTestEngine(t)
+	migrator = New(engine, &Options{
+		OnTableCreated: func(engine *xorm.Engine, table string) error {
+			_, err := engine.Exec(fmt.Sprintf(`CREATE TRIGGER reject BEFORE INSERT ON %s
+WHEN NEW.version = '202307241042' BEGIN SELECT RAISE(ABORT, 'rejected'); END`, table))
+			return err
+		},
+	}, []*Migration{
+		{Version: "202307241038", Migrate: func(*xorm.Engine) error { return nil }},
+		{Version: "202307241042", Migrate: func(*xorm.Engine) error { return nil }},
+	})
+	migrator.InitSchema(initSchema)
+	if err := migrator.Migrate(); err == nil {
+		t.Fatal("expected recording init schema to fail")
+	}
+	count, err := engine.Table(DefaultOptions.TableName).Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Fatalf("expected no init schema records, got %d", count)
+	}
+}
+
+func TestDidInitSchema(t *testing.T) {
+	engine := newTestEngine(t)
+	runs := 0
+	migrator := New(engine, &Options{}, nil)
+	migrator.InitSchema(func(tx *xorm.Engine) error {
+		runs++
+		_, err := tx.Exec("CREATE TABLE person (id INTEGER)")
+		return err
+	})
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !migrator.DidInitSchema() || runs != 1 {
+		t.Fatalf("expected init schema to run on a fresh database, ran %d times", runs)
+	}
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if migrator.DidInitSchema() || runs != 1 {
+		t.Fatalf("expected init schema to be skipped on an initialized database, ran %d times", runs)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	migrator := New(newTestEngine(t), &Options{VersionColumnSize: 64, InitSchemaSQL: []string{"SELECT 1"}}, nil)
+	config := migrator.Config()
+	if config.TableName != DefaultOptions.TableName || config.VersionColumnName != DefaultOptions.VersionColumnName {
+		t.Fatalf("expected defaults to be applied, got %q %q", config.TableName, config.VersionColumnName)
+	}
+	if config.VersionColumnSize != 64 {
+		t.Fatalf("expected explicit column size to be kept, got %d", config.VersionColumnSize)
+	}
+	
+	config.TableName = "other"
+	config.InitSchemaSQL[0] = "SELECT 2"
+	if again := migrator.Config(); again.TableName != DefaultOptions.TableName || again.InitSchemaSQL[0] != "SELECT 1" {
+		t.Fatal("expected Config to return a copy")
+	}
+}
+
+func TestNewMulti(t *testing.T) {
+	engines := map[string]*xorm.Engine{
+		"a": newTestEngine(t),
+		"b": newTestEngine(t),
+	}
+	if _, err := NewMulti(engines, "c", &Options{}, nil); !errors.Is(err, ErrPrimaryEngineNotFound) {
+		t.Fatalf("expected ErrPrimaryEngineNotFound, got %v", err)
+	}
+	
+	migrator, err := NewMulti(engines, "a", &Options{}, []*Migration{
+		tableMigration("202307241038", "person"),
+		{
+			Version: "202307241042",
+			MigrateMulti: func(engines map[string]*xorm.Engine) error {
+				if _, err := engines["a"].Exec("INSERT INTO person VALUES ('a')"); err != nil {
+					return err
+				}
+				_, err := engines["b"].Exec("CREATE TABLE archive (name varchar(255))")
+				return err
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := engines["a"].Table("person").Count(); count != 1 {
+		t.Fatalf("expected 1 person in primary, got %d", count)
+	}
+	if exist, _ := engines["b"].IsTableExist("archive"); !exist {
+		t.Fatal("expected archive table in secondary")
+	}
+	if exist, _ := engines["b"].IsTableExist(DefaultOptions.TableName); exist {
+		t.Fatal("expected migrations table only in primary")
+	}
+	
+	// 不是NewMulti创建时无法运行MigrateMulti
+	single := New(newTestEngine(t), &Options{}, []*Migration{{
+		Version:      "202307241038",
+		MigrateMulti: func(map[string]*xorm.Engine) error { return nil },
+	}})
+	if err := single.Migrate(); !errors.Is(err, ErrNoEngines) {
+		t.Fatalf("expected ErrNoEngines, got %v", err)
+	}
+}
+
+func TestOptimisticLocking(t *testing.T) {
+	dsn := "file:" + filepath.Join(t.TempDir(), "claim.db") + "?_busy_timeout=5000"
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var ranBy sync.Map
+	migrations := func(pod string) []*Migration {
+		return []*Migration{
+			{
+				Version: "202307241038",
+				Migrate: func(tx *xorm.Engine) error {
+					ranBy.Store("202307241038", pod)
+					close(started)
+					<-release
+					return nil
+				},
+			},
+			{
+				Version: "202307241039",
+				Migrate: func(tx *xorm.Engine) error {
+					ranBy.Store("202307241039", pod)
+					return nil
+				},
+			},
+		}
+	}
+	newMigrator := func(pod string) (*XorMigrate, *xorm.Engine) {
+		engine, err := xorm.NewEngine("sqlite3", dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			engine.Close()
+		})
+		return New(engine, &Options{OptimisticLocking: true}, migrations(pod)), engine
+	}
+	first, engine := newMigrator("first")
+	second, _ := newMigrator("second")
+	
+	firstDone := make(chan error, 1)
+	go func() {
+		firstDone <- first.Migrate()
+	}()
+	<-started
+	
+	// 第一个迁移正在运行时, 第二个运行跳过它并完成第二个迁移
+	if err := second.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-firstDone; err != nil {
+		t.Fatal(err)
+	}
+	
+	for version, pod := range map[string]string{"202307241038": "first", "202307241039": "second"} {
+		if got, _ := ranBy.Load(version); got != pod {
+			t.Fatalf("expected %s to be run by %s, got %v", version, pod, got)
+		}
+	}
+	applied, err := first.appliedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241039 202307241038]" {
+		t.Fatalf("unexpected applied migrations: %v", applied)
+	}
+	claims, err := engine.Table("migrations").Where("version LIKE ?", claimMigrationPrefix+"%").Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims != 0 {
+		t.Fatalf("expected claims to be removed, found %d", claims)
+	}
+}
+
+func TestVersionNotFoundError(t *testing.T) {
+	migrator := New(newTestEngine(t), &Options{}, []*Migration{tableMigration("202307241038", "person")})
+	for name, run := range map[string]func(string) error{
+		"MigrateTo":  migrator.MigrateTo,
+		"RollbackTo": migrator.RollbackTo,
+	} {
+		err := run("202307241083")
+		if !errors.Is(err, ErrMigrationVersionDoesNotExist) {
+			t.Fatalf("%s: expected ErrMigrationVersionDoesNotExist, got %v", name, err)
+		}
+		var notFound *VersionNotFoundError
+		if !errors.As(err, &notFound) || notFound.Version != "202307241083" {
+			t.Fatalf("%s: expected VersionNotFoundError, got %v", name, err)
+		}
+		if !strings.Contains(err.Error(), "202307241083") {
+			t.Fatalf("%s: expected version in message, got %v", name, err)
+		}
+	}
+}
+
+func TestRollbackToBatchesBookkeeping(t *testing.T) {
+	engine := newTestEngine(t)
+	var order []string
+	migrations := make([]*Migration, 0, 4)
+	for _, table := range []string{"a", "b", "c", "d"} {
+		migration := tableMigration("20230724103"+fmt.Sprint(len(migrations)), table)
+		rollback, version := migration.Rollback, migration.Version
+		migration.Rollback = func(tx *xorm.Engine) error {
+			order = append(order, version)
+			return rollback(tx)
+		}
+		migrations = append(migrations, migration)
+	}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	var sqlLog strings.Builder
+	engine.SetLogger(xorm.NewSimpleLogger(&sqlLog))
+	engine.ShowSQL(true)
+	if err := migrator.RollbackTo("202307241030"); err != nil {
+		t.Fatal(err)
+	}
+	engine.ShowSQL(false)
+	
+	if fmt.Sprint(order) != "[202307241033 202307241032 202307241031]" {
+		t.Fatalf("unexpected rollback order: %v", order)
+	}
+	if updates := strings.Count(sqlLog.String(), "UPDATE `migrations`"); updates != 1 {
+		t.Fatalf("expected a single bookkeeping update, got %d:\n%s", updates, sqlLog.String())
+	}
+	applied, err := migrator.appliedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241030]" {
+		t.Fatalf("unexpected applied migrations: %v", applied)
+	}
+}
+
+func TestMaxPending(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := make([]*Migration, 0, 50)
+	for i := 0; i < 50; i++ {
+		migrations = append(migrations, tableMigration(fmt.Sprintf("2023072410%02d", i), fmt.Sprintf("t%02d", i)))
+	}
+	
+	options := &Options{MaxPendingWarn: 20, MaxPendingFail: true}
+	migrator := New(engine, options, migrations)
+	if err := migrator.Migrate(); !errors.Is(err, ErrTooManyPending) || !strings.Contains(err.Error(), "50 pending") {
+		t.Fatalf("expected ErrTooManyPending, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("t00"); exist {
+		t.Fatal("no migration should run when the pending limit is exceeded")
+	}
+	// 只迁移到限制以内的version
+	if err := migrator.MigrateTo("202307241019"); err != nil {
+		t.Fatal(err)
+	}
+	
+	var logs strings.Builder
+	migrator.NewLogger(&logs)
+	defer migrator.DefaultLogger()
+	options.MaxPendingWarn, options.MaxPendingFail = 10, false
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "30 pending migrations exceed the limit of 10") {
+		t.Fatalf("expected pending warning, got %q", logs.String())
+	}
+}
+
+func TestOnTableCreated(t *testing.T) {
+	engine := newTestEngine(t)
+	var created []string
+	options := &Options{
+		OnTableCreated: func(engine *xorm.Engine, table string) error {
+			created = append(created, table)
+			return nil
+		},
+	}
+	for i := 0; i < 2; i++ {
+		if err := New(engine, options, []*Migration{tableMigration("202307241038", "person")}).Migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(created) != "[migrations]" {
+		t.Fatalf("expected hook to fire once, got %v", created)
+	}
+	
+	failing := &Options{
+		TableName: "other_migrations",
+		OnTableCreated: func(engine *xorm.Engine, table string) error {
+			return errors.New("grant failed")
+		},
+	}
+	if err := New(engine, failing, []*Migration{tableMigration("202307241039", "pet")}).Migrate(); err == nil || err.Error() != "grant failed" {
+		t.Fatalf("expected hook error to abort the run, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("pet"); exist {
+		t.Fatal("migration should not run after the hook failed")
+	}
+}
+
+func TestValidateChecksums(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	}
+	for i, migration := range migrations {
+		migration.Checksum = fmt.Sprintf("sum%d", i)
+	}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	mismatches, err := migrator.ValidateChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("expected no mismatches, got %v", mismatches)
+	}
+	
+	migrations[1].Checksum = "tampered"
+	mismatches, err = migrator.ValidateChecksums()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(mismatches) != "[{202307241039 sum1 tampered}]" {
+		t.Fatalf("unexpected mismatches: %v", mismatches)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	engine := newTestEngine(t)
+	var migrator *XorMigrate
+	paused := make(chan struct{})
+	var started sync.Map
+	person := tableMigration("202307241038", "person")
+	migrate := person.Migrate
+	person.Migrate = func(tx *xorm.Engine) error {
+		migrator.Pause()
+		close(paused)
+		return migrate(tx)
+	}
+	pet := tableMigration("202307241039", "pet")
+	migratePet := pet.Migrate
+	pet.Migrate = func(tx *xorm.Engine) error {
+		started.Store(pet.Version, true)
+		return migratePet(tx)
+	}
+	migrator = New(engine, &Options{}, []*Migration{person, pet})
+	
+	done := make(chan error, 1)
+	go func() {
+		done <- migrator.Migrate()
+	}()
+	<-paused
+	select {
+	case err := <-done:
+		t.Fatalf("migrate should wait while paused, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, ok := started.Load(pet.Version); ok {
+		t.Fatal("no migration should start while paused")
+	}
+	
+	migrator.Resume()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := started.Load(pet.Version); !ok {
+		t.Fatal("expected migration to run after resume")
+	}
+}
+
+func TestPauseCancelled(t *testing.T) {
+	migrator := New(newTestEngine(t), &Options{}, []*Migration{tableMigration("202307241038", "person")})
+	migrator.Pause()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var cancelled *CancelledError
+	if err := migrator.MigrateContext(ctx); !errors.As(err, &cancelled) {
+		t.Fatalf("expected CancelledError while paused, got %v", err)
+	}
+}
+
+func TestCurrentOperation(t *testing.T) {
+	release := make(chan struct{})
+	pet := tableMigration("202307241039", "pet")
+	migratePet := pet.Migrate
+	pet.Migrate = func(tx *xorm.Engine) error {
+		<-release
+		return migratePet(tx)
+	}
+	migrator := New(newTestEngine(t), &Options{}, []*Migration{tableMigration("202307241038", "person"), pet})
+	if op, _, _ := migrator.CurrentOperation(); op != OperationIdle {
+		t.Fatalf("expected idle before migrate, got %q", op)
+	}
+	
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- migrator.Migrate()
+	}()
+	deadline := time.After(5 * time.Second)
+	for {
+		op, version, since := migrator.CurrentOperation()
+		if op == OperationMigrating && version == pet.Version {
+			if since.Before(start) {
+				t.Fatalf("unexpected operation start time %s", since)
+			}
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatalf("expected to observe migration %s, last operation %q %q", pet.Version, op, version)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if op, version, _ := migrator.CurrentOperation(); op != OperationIdle || version != "" {
+		t.Fatalf("expected idle after migrate, got %q %q", op, version)
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	engine := newTestEngine(t)
+	person := tableMigration("202307241038", "person")
+	person.SkipIf = func(tx *xorm.Engine) (bool, string) {
+		return true, "person table is managed by another service"
+	}
+	pet := tableMigration("202307241039", "pet")
+	migratePet := pet.Migrate
+	pet.Migrate = func(tx *xorm.Engine) error {
+		if err := migratePet(tx); err != nil {
+			return err
+		}
+		return fmt.Errorf("%w: pet already exists", ErrSkipMigration)
+	}
+	migrator := New(engine, &Options{}, []*Migration{person, pet, tableMigration("202307241040", "toy")})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("skipped migration should not run")
+	}
+	
+	report, err := migrator.Reconcile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pending) != 0 || len(report.Applied) != 3 {
+		t.Fatalf("expected all migrations to be recorded as applied: %+v", report)
+	}
+	want := []ReconcileEntry{
+		{Version: "202307241038", Skipped: true, SkipReason: "person table is managed by another service"},
+		{Version: "202307241039", Skipped: true, SkipReason: "pet already exists"},
+		{Version: "202307241040"},
+	}
+	for i, entry := range report.Applied {
+		if entry.MigratedAt.IsZero() {
+			t.Fatalf("expected %s to have a migration time", entry.Version)
+		}
+		entry.MigratedAt = time.Time{}
+		if entry != want[i] {
+			t.Fatalf("expected %+v, got %+v", want[i], entry)
+		}
+	}
+}
+
+func TestWaitForTable(t *testing.T) {
+	engine := newTestEngine(t)
+	// 建表后前两次检查仍然看不到表
+	checks := 0
+	migrator := New(engine, &Options{
+		WaitForTable: time.Second,
+		TableExistsFunc: func(engine *xorm.Engine, table string) (bool, error) {
+			checks++
+			if checks <= 3 {
+				return false, nil
+			}
+			return engine.IsTableExist(table)
+		},
+	}, []*Migration{tableMigration("202307241038", "person")})
+	var waits int
+	migrator.sleep = func(ctx context.Context, d time.Duration) error {
+		waits++
+		return nil
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if waits != 2 {
+		t.Fatalf("expected to wait twice for the table, waited %d times", waits)
+	}
+	
+	migrator = New(newTestEngine(t), &Options{
+		WaitForTable: 50 * time.Millisecond,
+		TableExistsFunc: func(*xorm.Engine, string) (bool, error) {
+			return false, nil
+		},
+	}, []*Migration{tableMigration("202307241038", "person")})
+	if err := migrator.Migrate(); !errors.Is(err, ErrTableNotVisible) {
+		t.Fatalf("expected ErrTableNotVisible, got %v", err)
+	}
+}
+
+func TestConcurrentModification(t *testing.T) {
+	engine := newTestEngine(t)
+	pet := tableMigration("202307241039", "pet")
+	migratePet := pet.Migrate
+	pet.Migrate = func(tx *xorm.Engine) error {
+		// 模拟另一个进程在两个步骤之间运行了迁移
+		if _, err := tx.Exec(fmt.Sprintf("INSERT INTO %s (version) VALUES ('202307241099')", DefaultOptions.TableName)); err != nil {
+			return err
+		}
+		return migratePet(tx)
+	}
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202307241038", "person"),
+		pet,
+		tableMigration("202307241040", "toy"),
+	})
+	err := migrator.Migrate()
+	if !errors.Is(err, ErrConcurrentModification) || !strings.Contains(err.Error(), "+202307241099") {
+		t.Fatalf("expected ErrConcurrentModification, got %v", err)
+	}
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241038 202307241099]" {
+		t.Fatalf("expected the run to stop before recording pet, got %v", applied)
+	}
+}
+
+func TestUseTransaction(t *testing.T) {
+	run := func(useTransaction bool) (*XorMigrate, error) {
+		engine := newTestEngine(t)
+		person := tableMigration("202307241038", "person")
+		person.RollbackSQL = []string{"DROP TABLE person"}
+		migrator := New(engine, &Options{
+			UseTransaction:   useTransaction,
+			StoreRollbackSQL: true,
+			// 保存回滚语句时失败, 此时迁移记录已经写入
+			OnTableCreated: func(engine *xorm.Engine, table string) error {
+				_, err := engine.Exec(fmt.Sprintf(`CREATE TRIGGER reject BEFORE UPDATE OF rollback_sql ON %s
+BEGIN SELECT RAISE(ABORT, 'rejected'); END`, table))
+				return err
+			},
+		}, []*Migration{person})
+		return migrator, migrator.Migrate()
+	}
+	
+	migrator, err := run(true)
+	if err == nil {
+		t.Fatal("expected storing rollback SQL to fail")
+	}
+	if applied, _ := migrator.appliedVersions(); len(applied) != 0 {
+		t.Fatalf("expected the migration record to be rolled back, got %v", applied)
+	}
+	
+	migrator, err = run(false)
+	if err == nil {
+		t.Fatal("expected storing rollback SQL to fail")
+	}
+	if applied, _ := migrator.appliedVersions(); fmt.Sprint(applied) != "[202307241038]" {
+		t.Fatalf("expected the migration record to be kept without a transaction, got %v", applied)
+	}
+	
+	engine := newTestEngine(t)
+	migrator = New(engine, &Options{UseTransaction: true}, []*Migration{tableMigration("202307241038", "person")})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	if applied, _ := migrator.appliedVersions(); len(applied) != 0 {
+		t.Fatalf("expected the migration to be rolled back, got %v", applied)
+	}
+}
+
+func TestVerifyAfterCommitError(t *testing.T) {
+	commitErr := errors.New("connection reset")
+	noop := func(*xorm.Engine) error { return nil }
+	migrations := []*Migration{{Version: "202307241038", Migrate: noop}, {Version: "202307241039", Migrate: noop}}
+	
+	// 迁移记录在事务中写入, 提交失败时没有写入数据库
+	engine, err := xorm.NewEngine("sqlite3", "file:"+filepath.Join(t.TempDir(), "x.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		engine.Close()
+	})
+	migrator := New(engine, &Options{LockMigrationsTable: true, VerifyAfterCommitError: true}, migrations)
+	migrator.commitTx = func(session *xorm.Session) error {
+		session.Rollback()
+		return commitErr
+	}
+	var e *CommitError
+	if err := migrator.Migrate(); !errors.As(err, &e) || !errors.Is(err, commitErr) {
+		t.Fatalf("expected CommitError, got %v", err)
+	}
+	if !e.Verified || e.Persisted || strings.Join(e.Missing, ",") != "202307241038,202307241039" {
+		t.Fatalf("expected migrations not to be persisted, got %+v", e)
+	}
+	
+	// 默认配置下迁移记录逐条自动提交, 提交失败时记录已经写入
+	migrator = New(newTestEngine(t), &Options{VerifyAfterCommitError: true}, migrations)
+	migrator.commitTx = func(*xorm.Session) error {
+		return commitErr
+	}
+	if err := migrator.Migrate(); !errors.As(err, &e) {
+		t.Fatalf("expected CommitError, got %v", err)
+	}
+	if !e.Verified || !e.Persisted || len(e.Missing) != 0 {
+		t.Fatalf("expected migrations to be persisted, got %+v", e)
+	}
+	
+	// 未开启时返回原始错误
+	migrator = New(newTestEngine(t), &Options{}, migrations)
+	migrator.commitTx = func(*xorm.Session) error {
+		return commitErr
+	}
+	if err := migrator.Migrate(); err != commitErr {
+		t.Fatalf("expected raw commit error, got %v", err)
+	}
+}
+
+func TestOnCommit(t *testing.T) {
+	engine := newTestEngine(t)
+	var committed [][]string
+	options := &Options{
+		OnCommit: func(appliedVersions []string) error {
+			committed = append(committed, appliedVersions)
+			return nil
+		},
+	}
+	failing := tableMigration("202307241040", "toy")
+	failing.Migrate = func(tx *xorm.Engine) error {
+		return errors.New("boom")
+	}
+	migrations := []*Migration{tableMigration("202307241038", "person"), tableMigration("202307241039", "pet"), failing}
+	migrator := New(engine, options, migrations)
+	if err := migrator.MigrateTo("202307241038"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err == nil {
+		t.Fatal("expected migration to fail")
+	}
+	if fmt.Sprint(committed) != "[[202307241038]]" {
+		t.Fatalf("expected OnCommit only after the successful run, got %v", committed)
+	}
+	
+	failing.Migrate = tableMigration("202307241040", "toy").Migrate
+	options.OnCommit = func(appliedVersions []string) error {
+		return fmt.Errorf("notify %v", appliedVersions)
+	}
+	if err := migrator.Migrate(); err == nil || err.Error() != "notify [202307241040]" {
+		t.Fatalf("expected OnCommit error, got %v", err)
+	}
+	// 已经提交的迁移不会因为OnCommit的错误回滚
+	if ran, err := migrator.migrationRan(failing); err != nil || !ran {
+		t.Fatalf("expected migration to stay committed, ran=%v err=%v", ran, err)
+	}
+}
+
+func TestBeforeAfterMigrate(t *testing.T) {
+	engine, err := xorm.NewEngine("sqlite3", "file:"+filepath.Join(t.TempDir(), "x.db")+"?_busy_timeout=5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		engine.Close()
+	})
+	var calls []string
+	// 迁移在LockMigrationsTable的事务中运行, 避免SQLite的写锁冲突
+	person := &Migration{
+		Version: "202401010000",
+		MigrateTx: func(tx *xorm.Session) error {
+			calls = append(calls, "migrate")
+			_, err := tx.Exec("CREATE TABLE person (id INTEGER)")
+			return err
+		},
+	}
+	options := &Options{
+		LockMigrationsTable: true,
+		BeforeMigrate: func(session *xorm.Session) error {
+			calls = append(calls, "before")
+			return nil
+		},
+		AfterMigrate: func(session *xorm.Session) error {
+			calls = append(calls, "after")
+			return errors.New("boom")
+		},
+	}
+	migrator := New(engine, options, []*Migration{person})
+	if err := migrator.Migrate(); err == nil || err.Error() != "boom" {
+		t.Fatalf("expected AfterMigrate error, got %v", err)
+	}
+	if fmt.Sprint(calls) != "[before migrate after]" {
+		t.Fatalf("unexpected call order: %v", calls)
+	}
+	// AfterMigrate失败时迁移记录被回滚
+	if ran, err := migrator.HasRun("202401010000"); err != nil || ran {
+		t.Fatalf("expected migration record to be rolled back, ran=%v err=%v", ran, err)
+	}
+	
+	calls = nil
+	options.BeforeMigrate = func(session *xorm.Session) error {
+		calls = append(calls, "before")
+		return errors.New("not ready")
+	}
+	if err := migrator.Migrate(); err == nil || err.Error() != "not ready" {
+		t.Fatalf("expected BeforeMigrate error, got %v", err)
+	}
+	if fmt.Sprint(calls) != "[before]" {
+		t.Fatalf("no migration should run after BeforeMigrate fails: %v", calls)
+	}
+}
+
+func TestAfterMigrateErrorWithoutLock(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{tableMigration("202401010000", "person"), tableMigration("202401020000", "pet")}
+	migrator := New(engine, &Options{
+		AfterMigrate: func(session *xorm.Session) error {
+			return errors.New("boom")
+		},
+	}, migrations)
+	if err := migrator.Migrate(); err == nil || err.Error() != "boom" {
+		t.Fatalf("expected AfterMigrate error, got %v", err)
+	}
+	// 没有开启LockMigrationsTable时迁移记录已经逐条提交
+	applied, err := migrator.appliedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202401010000 202401020000]" {
+		t.Fatalf("expected migration records to stay committed, got %v", applied)
+	}
+}
+
+func TestMigrateWhere(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+	}
+	migrations[0].Description = "backfill person names"
+	migrations[1].Description = "create pet"
+	migrations[2].Description = "backfill toy owners"
+	migrator := New(engine, &Options{}, migrations)
+	
+	err := migrator.MigrateWhere(func(m *Migration) bool {
+		return strings.Contains(m.Description, "backfill")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.appliedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241038 202307241040]" {
+		t.Fatalf("unexpected applied migrations: %v", applied)
+	}
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := engine.IsTableExist("pet"); !exist {
+		t.Fatal("expected the gap to be filled by a later Migrate")
+	}
+}
+
+func TestMigrateByTag(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038", "person"),
+		tableMigration("202307241039", "pet"),
+		tableMigration("202307241040", "toy"),
+		tableMigration("202307241041", "food"),
+	}
+	migrations[0].Tags = []string{"users"}
+	migrations[1].Tags = []string{"shop"}
+	migrations[2].Tags = []string{"shop", "users"}
+	migrator := New(engine, &Options{}, migrations)
+	
+	if err := migrator.MigrateByTag("users"); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.appliedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202307241038 202307241040]" {
+		t.Fatalf("unexpected applied migrations: %v", applied)
+	}
+	if exist, _ := engine.IsTableExist("food"); exist {
+		t.Fatal("untagged migration should not run")
+	}
+}
+
+func TestVerifyInitMatchesMigrations(t *testing.T) {
+	factory := func() (*xorm.Engine, error) {
+		engine, err := xorm.NewEngine("sqlite3", ":memory:")
+		if err != nil {
+			return nil, err
+		}
+		engine.SetMaxOpenConns(1)
+		return engine, nil
+	}
+	migrator := New(newTestEngine(t), DefaultOptions, []*Migration{tableMigration("202401010000", "person")})
+	if err := migrator.VerifyInitMatchesMigrations(factory); !errors.Is(err, ErrNoInitSchema) {
+		t.Fatalf("expected ErrNoInitSchema, got %v", err)
+	}
+	
+	migrator.InitSchema(func(engine *xorm.Engine) error {
+		_, err := engine.Exec("CREATE TABLE person (id INTEGER)")
+		return err
+	})
+	if err := migrator.VerifyInitMatchesMigrations(factory); err != nil {
+		t.Fatal(err)
+	}
+	
+	// InitSchema多了一列, 迁移中没有
+	migrator.InitSchema(func(engine *xorm.Engine) error {
+		_, err := engine.Exec("CREATE TABLE person (id INTEGER, name TEXT)")
+		return err
+	})
+	err := migrator.VerifyInitMatchesMigrations(factory)
+	if !errors.Is(err, ErrSchemaDrift) {
+		t.Fatalf("expected ErrSchemaDrift, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "column person.name only in init schema") {
+		t.Fatalf("unexpected drift report: %v", err)
+	}
+}
+
+func TestMigrationLookup(t *testing.T) {
+	migrator := New(newTestEngine(t), DefaultOptions, []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+	})
+	migration, ok := migrator.Migration("202401020000")
+	if !ok || migration.Version != "202401020000" {
+		t.Fatalf("expected to find 202401020000, got %v, %v", migration, ok)
+	}
+	if migration, ok := migrator.Migration("202401030000"); ok || migration != nil {
+		t.Fatalf("expected not found, got %v, %v", migration, ok)
+	}
+	if migration, ok := migrator.GetMigration("202401010000"); !ok || migration.Rollback == nil {
+		t.Fatalf("expected to find 202401010000 with a rollback, got %v, %v", migration, ok)
+	}
+}
+
+func TestContentChecksum(t *testing.T) {
+	engine := newTestEngine(t)
+	person := &Migration{
+		Version: "202401010000",
+		Content: "CREATE TABLE person (id INTEGER)",
+		Migrate: func(tx *xorm.Engine) error { return nil },
+	}
+	if err := New(engine, &Options{}, []*Migration{person}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := engine.QueryString("SELECT checksum FROM migrations WHERE version = ?", person.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["checksum"] != person.checksum() || len(rows[0]["checksum"]) != 64 {
+		t.Fatalf("expected sha256 of content to be stored, got %v", rows)
+	}
+	
+	person.Content = "CREATE TABLE person (id INTEGER, name TEXT)"
+	if err := New(engine, &Options{}, []*Migration{person}).Migrate(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("expected ErrChecksumMismatch, got %v", err)
+	}
+	if err := New(engine, &Options{SkipChecksumValidation: true}, []*Migration{person}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHasRun(t *testing.T) {
+	migrator := New(newTestEngine(t), DefaultOptions, []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+	})
+	if ran, err := migrator.HasRun("202401010000"); err != nil || ran {
+		t.Fatalf("expected false before the migrations table exists, got %v, %v", ran, err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	for version, expected := range map[string]bool{"202401010000": true, "202401020000": false, "202401030000": false} {
+		ran, err := migrator.HasRun(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ran != expected {
+			t.Fatalf("HasRun(%s) = %v, expected %v", version, ran, expected)
+		}
+	}
+}
+
+func TestModelCached(t *testing.T) {
+	migrator := New(newTestEngine(t), &Options{VersionColumnName: "id_version", VersionColumnSize: 64}, nil)
+	first, second := migrator.model(), migrator.model()
+	if first == second {
+		t.Fatal("model should return a new value on every call")
+	}
+	if reflect.TypeOf(first) != reflect.TypeOf(second) {
+		t.Fatal("model should reuse the same struct type")
+	}
+	
+	// 缓存的类型与直接生成的类型字段一致
+	built := migrator.buildModelType()
+	cached := reflect.TypeOf(first).Elem()
+	if cached.NumField() != built.NumField() {
+		t.Fatalf("expected %d fields, got %d", built.NumField(), cached.NumField())
+	}
+	for i := 0; i < built.NumField(); i++ {
+		if cached.Field(i).Name != built.Field(i).Name || cached.Field(i).Tag != built.Field(i).Tag {
+			t.Fatalf("field %d differs: %v != %v", i, cached.Field(i), built.Field(i))
+		}
+	}
+}
+
+func BenchmarkModel(b *testing.B) {
+	engine, err := xorm.NewEngine("sqlite3", ":memory:")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer engine.Close()
+	migrator := New(engine, &Options{}, nil)
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			migrator.model()
+		}
+	})
+	b.Run("uncached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reflect.New(migrator.buildModelType()).Interface()
+		}
+	})
+}
+
+func TestRequireDescription(t *testing.T) {
+	described := tableMigration("202401010000", "person")
+	described.Description = "create person"
+	migrations := []*Migration{described, tableMigration("202401020000", "pet")}
+	
+	engine := newTestEngine(t)
+	err := New(engine, &Options{RequireDescription: true}, migrations).Migrate()
+	if !errors.Is(err, ErrMissingDescription) {
+		t.Fatalf("expected ErrMissingDescription, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "202401020000") || strings.Contains(err.Error(), "202401010000") {
+		t.Fatalf("error should name only the migration without description: %v", err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("no migration should run when validation fails")
+	}
+	
+	if err := New(engine, &Options{}, migrations).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMissingMigrateFunc(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202401010000", "person"),
+		{Version: "202401020000", Description: "forgot the function"},
+	}
+	err := New(engine, &Options{}, migrations).Migrate()
+	if !errors.Is(err, ErrMissingMigrateFunc) || !strings.Contains(err.Error(), "202401020000") {
+		t.Fatalf("expected ErrMissingMigrateFunc naming 202401020000, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("no migration should run when validation fails")
+	}
+	
+	migrations[1].MigrateTx = func(*xorm.Session) error { return nil }
+	if err := New(engine, &Options{}, migrations).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateWithResult(t *testing.T) {
+	engine := newTestEngine(t)
+	skipped := tableMigration("202401020000", "pet")
+	skipped.SkipIf = func(*xorm.Engine) (bool, string) { return true, "pet already exists" }
+	migrations := []*Migration{
+		tableMigration("202401010000", "person"),
+		skipped,
+		tableMigration("202401030000", "toy"),
+	}
+	if err := New(engine, &Options{}, migrations[:1]).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	result, err := New(engine, &Options{}, migrations).MigrateWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(result.Applied) != "[202401030000]" {
+		t.Fatalf("unexpected applied migrations: %v", result.Applied)
+	}
+	if fmt.Sprint(result.Skipped) != "[202401020000]" {
+		t.Fatalf("unexpected skipped migrations: %v", result.Skipped)
+	}
+	if len(result.Durations) != 2 {
+		t.Fatalf("expected durations for the applied and skipped migrations, got %v", result.Durations)
+	}
+	if _, ok := result.Durations["202401010000"]; ok {
+		t.Fatal("migrations that already ran should not be timed")
+	}
+	if result.Duration <= 0 {
+		t.Fatalf("expected total duration, got %s", result.Duration)
+	}
+	
+	result, err = New(engine, &Options{}, migrations).MigrateWithResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Applied) != 0 || len(result.Skipped) != 0 {
+		t.Fatalf("expected nothing to run, got %+v", result)
+	}
+}
+
+func TestMigrationTimeout(t *testing.T) {
+	engine := newTestEngine(t)
+	slow := &Migration{
+		Version: "202401020000",
+		Timeout: 20 * time.Millisecond,
+		Migrate: func(tx *xorm.Engine) error {
+			time.Sleep(200 * time.Millisecond)
+			return nil
+		},
+	}
+	migrations := []*Migration{tableMigration("202401010000", "person"), slow}
+	
+	err := New(engine, &Options{MigrationTimeout: time.Minute}, migrations).Migrate()
+	if !errors.Is(err, ErrMigrationTimeout) {
+		t.Fatalf("expected ErrMigrationTimeout, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "202401020000") {
+		t.Fatalf("error should name the migration: %v", err)
+	}
+	
+	// 超时的迁移函数返回后引擎恢复正常
+	time.Sleep(250 * time.Millisecond)
+	slow.Timeout = 0
+	if err := New(engine, &Options{MigrationTimeout: time.Second}, migrations).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	ran, err := New(engine, &Options{}, migrations).HasRun("202401020000")
+	if err != nil || !ran {
+		t.Fatalf("expected migration to run within the global timeout, got %v, %v", ran, err)
+	}
+	
+	// MigrateCtx通过ctx得知超时
+	interrupted := make(chan error, 1)
+	migrations = append(migrations, &Migration{
+		Version: "202401030000",
+		Timeout: 20 * time.Millisecond,
+		MigrateCtx: func(ctx context.Context, tx *xorm.Engine) error {
+			<-ctx.Done()
+			interrupted <- ctx.Err()
+			return ctx.Err()
+		},
+	})
+	if err := New(engine, &Options{}, migrations).Migrate(); !errors.Is(err, ErrMigrationTimeout) {
+		t.Fatalf("expected ErrMigrationTimeout, got %v", err)
+	}
+	if err := <-interrupted; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the migration context to time out, got %v", err)
+	}
+	if _, err := engine.Exec("CREATE TABLE pet (id INTEGER)"); err != nil {
+		t.Fatalf("engine queries should not inherit the migration deadline: %v", err)
+	}
+}
+
+func TestEntryPointContexts(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{tableMigration("202401010000", "person"), tableMigration("202401020000", "pet")}
+	migrations[1].RollbackSQL = []string{"DROP TABLE pet"}
+	migrator := New(engine, &Options{StoreRollbackSQL: true}, migrations)
+	if err := migrator.MigrateAs("deploy-1"); err != nil {
+		t.Fatal(err)
+	}
+	
+	// ctx已经取消时不会修改数据库
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := map[string]func() error{
+		"RollbackMigrationContext": func() error { return migrator.RollbackMigrationContext(ctx, migrations[1]) },
+		"RollbackStoredContext":    func() error { return migrator.RollbackStoredContext(ctx, "202401020000") },
+		"RollbackDeployContext":    func() error { return migrator.RollbackDeployContext(ctx, "deploy-1") },
+		"RollbackAllContext":       func() error { return migrator.RollbackAllContext(ctx) },
+		"StepContext":              func() error { return migrator.StepContext(ctx, -1) },
+		"RefreshContext":           func() error { return migrator.RefreshContext(ctx) },
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: expected context.Canceled, got %v", name, err)
+		}
+	}
+	if applied, err := migrator.AppliedMigrations(); err != nil || fmt.Sprint(applied) != "[202401010000 202401020000]" {
+		t.Fatalf("expected nothing to be rolled back, got %v, %v", applied, err)
+	}
+	assertTables := func(expected bool) {
+		t.Helper()
+		for _, table := range []string{"person", "pet"} {
+			if exist, _ := engine.IsTableExist(table); exist != expected {
+				t.Fatalf("expected table %s to exist: %v", table, expected)
+			}
+		}
+	}
+	assertTables(true)
+	
+	if err := migrator.RollbackAllContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertTables(false)
+	for name, call := range map[string]func() error{
+		"MigrateWhereContext":       func() error { return migrator.MigrateWhereContext(ctx, func(*Migration) bool { return true }) },
+		"MigrateByTagContext":       func() error { return migrator.MigrateByTagContext(ctx, "api") },
+		"MigrateToExclusiveContext": func() error { return migrator.MigrateToExclusiveContext(ctx, "202401020000") },
+		"StepContext":               func() error { return migrator.StepContext(ctx, 1) },
+	} {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Fatalf("%s: expected context.Canceled, got %v", name, err)
+		}
+	}
+	assertTables(false)
+}
+
+func TestMigrateTxTimeout(t *testing.T) {
+	engine := newTestEngine(t)
+	slow := &Migration{
+		Version: "202401010000",
+		Timeout: 50 * time.Millisecond,
+		MigrateTx: func(tx *xorm.Session) error {
+			_, err := tx.Exec("WITH RECURSIVE c(x) AS (SELECT 1 UNION ALL SELECT x + 1 FROM c) SELECT count(*) FROM c")
+			return err
+		},
+	}
+	migrator := New(engine, &Options{}, []*Migration{slow})
+	if err := migrator.Migrate(); !errors.Is(err, ErrMigrationTimeout) {
+		t.Fatalf("expected ErrMigrationTimeout, got %v", err)
+	}
+	if ran, err := migrator.HasRun(slow.Version); err != nil || ran {
+		t.Fatalf("expected the timed out migration not to be recorded, got %v, %v", ran, err)
+	}
+	
+	// 超时前返回的MigrateTx正常记录, panic同样可以恢复
+	person := &Migration{
+		Version: "202401010000",
+		Timeout: time.Minute,
+		MigrateTx: func(tx *xorm.Session) error {
+			_, err := tx.Exec("CREATE TABLE person (id INTEGER)")
+			return err
+		},
+	}
+	panicking := &Migration{
+		Version: "202401020000",
+		Timeout: time.Minute,
+		MigrateTx: func(*xorm.Session) error {
+			panic("nil map")
+		},
+	}
+	migrator = New(engine, &Options{RecoverPanics: true}, []*Migration{person, panicking})
+	if err := migrator.Migrate(); !errors.Is(err, ErrMigrationPanicked) {
+		t.Fatalf("expected ErrMigrationPanicked, got %v", err)
+	}
+	if ran, err := migrator.HasRun(person.Version); err != nil || !ran {
+		t.Fatalf("expected the migration within its timeout to be recorded, got %v, %v", ran, err)
+	}
+}
+
+func TestWithValue(t *testing.T) {
+	type tenantKey struct{}
+	engine := newTestEngine(t)
+	var tenant interface{}
+	migrator := New(engine, &Options{}, []*Migration{{
+		Version: "202401010000",
+		MigrateCtx: func(ctx context.Context, tx *xorm.Engine) error {
+			tenant = ctx.Value(tenantKey{})
+			_, err := tx.Exec("CREATE TABLE person (id INTEGER)")
+			return err
+		},
+	}}).WithValue(tenantKey{}, "acme")
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if tenant != "acme" {
+		t.Fatalf("expected injected value, got %v", tenant)
+	}
+	if exist, _ := engine.IsTableExist("person"); !exist {
+		t.Fatal("expected MigrateCtx to run")
+	}
+}
+
+func TestCustomColumnNames(t *testing.T) {
+	engine := newTestEngine(t)
+	options := &Options{RollbackColumnName: "mig_rolled_back", IDColumnName: "mig_id"}
+	migrations := []*Migration{tableMigration("202401010000", "person"), tableMigration("202401020000", "pet")}
+	migrator := New(engine, options, migrations)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := engine.QueryString("SELECT version FROM migrations WHERE mig_rolled_back = 1 ORDER BY mig_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["version"] != "202401020000" {
+		t.Fatalf("unexpected rolled back rows: %v", rows)
+	}
+	stats, err := migrator.TableStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RolledBackRows != 1 || stats.CurrentVersion != "202401010000" {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if ran, err := migrator.HasRun("202401020000"); err != nil || !ran {
+		t.Fatalf("expected re-applied migration, got %v, %v", ran, err)
+	}
+}
+
+func TestVersionAsPrimaryKey(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401030000", "toy"),
+	}
+	migrator := New(engine, &Options{VersionAsPrimaryKey: true, ValidateUnknownMigrations: true}, migrations)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	metas, err := engine.DBMetas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var table *core.Table
+	for _, meta := range metas {
+		if meta.Name == "migrations" {
+			table = meta
+		}
+	}
+	if table == nil || table.GetColumn("id") != nil {
+		t.Fatal("expected migrations table without id column")
+	}
+	if fmt.Sprint(table.PrimaryKeys) != "[version]" {
+		t.Fatalf("expected version to be the primary key, got %v", table.PrimaryKeys)
+	}
+	
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202401010000 202401020000 202401030000]" {
+		t.Fatalf("unexpected applied migrations: %v", applied)
+	}
+	
+	migrator = New(engine, &Options{VersionAsPrimaryKey: true}, migrations[1:])
+	if unknown, err := migrator.UnknownMigrations(); err != nil || fmt.Sprint(unknown) != "[202401010000]" {
+		t.Fatalf("unexpected unknown migrations: %v, %v", unknown, err)
+	}
+	if removed, err := migrator.DedupeRecords(); err != nil || removed != 0 {
+		t.Fatalf("expected nothing to dedupe without an id column, got %d, %v", removed, err)
+	}
+}
+
+func TestRecordRunPlan(t *testing.T) {
+	engine := newTestEngine(t)
+	crash := errors.New("crash")
+	pet := tableMigration("202401020000", "pet")
+	migrate := pet.Migrate
+	pet.Migrate = func(tx *xorm.Engine) error { return crash }
+	migrations := []*Migration{tableMigration("202401010000", "person"), pet, tableMigration("202401030000", "toy")}
+	
+	var stale *StaleRunPlan
+	options := &Options{
+		RecordRunPlan: true,
+		OnStaleRunPlan: func(plan *StaleRunPlan) error {
+			stale = plan
+			return nil
+		},
+	}
+	migrator := New(engine, options, migrations)
+	if err := migrator.Migrate(); !errors.Is(err, crash) {
+		t.Fatalf("expected crash, got %v", err)
+	}
+	if stale != nil {
+		t.Fatalf("first run should not report a stale plan, got %+v", stale)
+	}
+	
+	pet.Migrate = migrate
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if stale == nil {
+		t.Fatal("expected the stale plan of the crashed run to be reported")
+	}
+	if fmt.Sprint(stale.Versions) != "[202401010000 202401020000 202401030000]" ||
+		fmt.Sprint(stale.Applied) != "[202401010000]" ||
+		fmt.Sprint(stale.Remaining) != "[202401020000 202401030000]" {
+		t.Fatalf("unexpected stale plan: %+v", stale)
+	}
+	if stale.StartedAt.IsZero() {
+		t.Fatal("expected start time of the crashed run")
+	}
+	
+	plan, err := migrator.StaleRunPlan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan != nil {
+		t.Fatalf("plan should be cleared after a successful run, got %+v", plan)
+	}
+}
+
+func TestRollbackReason(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{tableMigration("202401010000", "person"), tableMigration("202401020000", "pet")}
+	migrator := New(engine, &Options{DefaultRollbackReason: "routine rollback"}, migrations)
+	reasons := func() string {
+		rows, err := engine.Table(DefaultOptions.TableName).Cols("version", "rollback_reason", "rolled_back_at").Asc("id").QueryString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, row := range rows {
+			if row["rollback_reason"] != "" && row["rolled_back_at"] == "" {
+				t.Fatalf("expected rolled_back_at with the reason: %v", row)
+			}
+			got = append(got, row["version"]+"="+row["rollback_reason"])
+		}
+		return strings.Join(got, ",")
+	}
+	
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLastReason("bad index on pet"); err != nil {
+		t.Fatal(err)
+	}
+	if got := reasons(); got != "202401010000=,202401020000=bad index on pet" {
+		t.Fatalf("unexpected reasons: %s", got)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	if got := reasons(); got != "202401010000=routine rollback,202401020000=bad index on pet" {
+		t.Fatalf("expected the default reason, got %s", got)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := reasons(); got != "202401010000=,202401020000=" {
+		t.Fatalf("expected reasons to be cleared after migrating again, got %s", got)
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202307241038_person", "person"),
+		tableMigration("202307241044_pet", "pet"),
+		tableMigration("202307241039_toy", "toy"),
+	}
+	err := New(engine, &Options{ValidateOrder: true}, migrations).Migrate()
+	if !errors.Is(err, ErrMigrationsOutOfOrder) {
+		t.Fatalf("expected ErrMigrationsOutOfOrder, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "202307241044_pet is registered before 202307241039_toy") {
+		t.Fatalf("error should name the first offending pair: %v", err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("no migration should run when the order is invalid")
+	}
+	
+	migrations[1], migrations[2] = migrations[2], migrations[1]
+	if err := New(engine, &Options{ValidateOrder: true}, migrations).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAutoSort(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202401030000", "toy"),
+		tableMigration("202401010000_person", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401010000_owner", "owner"),
+	}
+	migrator := New(engine, &Options{AutoSort: true, ValidateOrder: true}, migrations)
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202401010000_owner 202401010000_person 202401020000 202401030000]" {
+		t.Fatalf("unexpected applied order: %v", applied)
+	}
+	if migrations[0].Version != "202401030000" {
+		t.Fatal("AutoSort should not reorder the caller's slice")
+	}
+	
+	err = New(newTestEngine(t), &Options{ValidateOrder: true}, migrations).Migrate()
+	if !errors.Is(err, ErrMigrationsOutOfOrder) {
+		t.Fatalf("expected ErrMigrationsOutOfOrder without AutoSort, got %v", err)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	engine := newTestEngine(t)
+	person := tableMigration("202401010000", "person")
+	person.Description = "create person"
+	pet := tableMigration("202401020000", "pet")
+	pet.Description = "create pet"
+	migrations := []*Migration{person, pet}
+	if err := New(engine, &Options{}, migrations[:1]).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	var logs strings.Builder
+	migrator := New(engine, &Options{DryRun: true}, migrations)
+	migrator.NewLogger(&logs)
+	defer migrator.DefaultLogger()
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "would apply migration 202401020000: create pet") {
+		t.Fatalf("expected pending migration to be logged, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "202401010000") {
+		t.Fatalf("applied migration should not be logged, got %q", logs.String())
+	}
+	if exist, _ := engine.IsTableExist("pet"); exist {
+		t.Fatal("dry run should not run migrations")
+	}
+	if ran, err := migrator.HasRun("202401020000"); err != nil || ran {
+		t.Fatalf("dry run should not record migrations, got %v, %v", ran, err)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401030000", "toy"),
+	}
+	migrator := New(engine, &Options{}, migrations)
+	statuses, err := migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 3 || statuses[0].Applied || !statuses[0].InCode {
+		t.Fatalf("expected all migrations pending before the table exists, got %+v", statuses)
+	}
+	
+	if err := New(engine, &Options{}, append(migrations, tableMigration("202401040000", "removed"))).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackMigration(migrations[2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackMigration(migrations[1]); err != nil {
+		t.Fatal(err)
+	}
+	skipped := *migrations[1]
+	skipped.SkipIf = func(*xorm.Engine) (bool, string) {
+		return true, "table managed elsewhere"
+	}
+	if err := New(engine, &Options{}, []*Migration{migrations[0], &skipped}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	statuses, err = migrator.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []MigrationStatus{
+		{Version: "202401010000", Applied: true, InCode: true},
+		{Version: "202401020000", Applied: true, InCode: true, Skipped: true, SkipReason: "table managed elsewhere"},
+		{Version: "202401030000", RolledBack: true, InCode: true},
+		{Version: "202401040000", Applied: true},
+	}
+	if fmt.Sprint(statuses) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected status:\n%+v\nexpected:\n%+v", statuses, expected)
+	}
+}
+
+func TestMigrateTx(t *testing.T) {
+	engine := newTestEngine(t)
+	if _, err := engine.Exec("CREATE TABLE person (name varchar(255))"); err != nil {
+		t.Fatal(err)
+	}
+	seed := func(version, name string) *Migration {
+		return &Migration{
+			Version: version,
+			MigrateTx: func(tx *xorm.Session) error {
+				_, err := tx.Exec("INSERT INTO person (name) VALUES (?)", name)
+				return err
+			},
+		}
+	}
+	names := func() string {
+		rows, err := engine.QueryString("SELECT name FROM person ORDER BY name")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, row := range rows {
+			got = append(got, row["name"])
+		}
+		return strings.Join(got, ",")
+	}
+	
+	options := &Options{
+		OnTableCreated: func(engine *xorm.Engine, table string) error {
+			_, err := engine.Exec(fmt.Sprintf(`CREATE TRIGGER reject BEFORE INSERT ON %s
+WHEN NEW.version = '202401020000' BEGIN SELECT RAISE(ABORT, 'rejected'); END`, table))
+			return err
+		},
+	}
+	migrations := []*Migration{seed("202401010000", "alice"), seed("202401020000", "bob")}
+	if err := New(engine, options, migrations).Migrate(); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected the migration record to be rejected, got %v", err)
+	}
+	// 记录失败时迁移中的修改一起回滚
+	if got := names(); got != "alice" {
+		t.Fatalf("expected only the recorded migration's data, got %q", got)
+	}
+	if ran, err := New(engine, options, migrations).HasRun("202401020000"); err != nil || ran {
+		t.Fatalf("expected 202401020000 not to be recorded, got %v, %v", ran, err)
+	}
+}
+
+func TestRollbackTx(t *testing.T) {
+	engine := newTestEngine(t)
+	if _, err := engine.Exec("CREATE TABLE person (name varchar(255))"); err != nil {
+		t.Fatal(err)
+	}
+	seed := func(version, name string) *Migration {
+		return &Migration{
+			Version: version,
+			MigrateTx: func(tx *xorm.Session) error {
+				_, err := tx.Exec("INSERT INTO person (name) VALUES (?)", name)
+				return err
+			},
+			RollbackTx: func(tx *xorm.Session) error {
+				_, err := tx.Exec("DELETE FROM person WHERE name = ?", name)
+				return err
+			},
+		}
+	}
+	count := func() int64 {
+		n, err := engine.Table("person").Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	
+	options := &Options{
+		OnTableCreated: func(engine *xorm.Engine, table string) error {
+			_, err := engine.Exec(fmt.Sprintf(`CREATE TRIGGER reject BEFORE UPDATE ON %s
+WHEN NEW.version = '202401020000' AND NEW.is_rollback = 1 BEGIN SELECT RAISE(ABORT, 'rejected'); END`, table))
+			return err
+		},
+	}
+	migrator := New(engine, options, []*Migration{seed("202401010000", "alice"), seed("202401020000", "bob")})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected marking the rollback to be rejected, got %v", err)
+	}
+	// 标记失败时回滚函数的修改一起撤销
+	if n := count(); n != 2 {
+		t.Fatalf("expected the rollback to be undone, got %d rows", n)
+	}
+	if ran, err := migrator.HasRun("202401020000"); err != nil || !ran {
+		t.Fatalf("expected 202401020000 to stay applied, got %v, %v", ran, err)
+	}
+	
+	if _, err := engine.Exec("DROP TRIGGER reject"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackAll(); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 0 {
+		t.Fatalf("expected all rows to be removed, got %d", n)
+	}
+	if applied, err := migrator.AppliedMigrations(); err != nil || len(applied) != 0 {
+		t.Fatalf("expected no applied migrations, got %v, %v", applied, err)
+	}
+}
+
+func TestRollbackAll(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401030000", "toy"),
+		tableMigration("202401040000", "food"),
+	}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.MigrateTo("202401030000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackAll(); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"person", "pet", "toy"} {
+		if exist, _ := engine.IsTableExist(table); exist {
+			t.Fatalf("expected table %s to be dropped", table)
+		}
+	}
+	if applied, err := migrator.AppliedMigrations(); err != nil || len(applied) != 0 {
+		t.Fatalf("expected no applied migrations, got %v, %v", applied, err)
+	}
+	
+	// 遇到不能回滚的迁移时停止, 之前的回滚仍被记录
+	migrations[1].Rollback = nil
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	err := migrator.RollbackAll()
+	if !errors.Is(err, ErrRollbackImpossible) || !strings.Contains(err.Error(), "202401020000") {
+		t.Fatalf("expected ErrRollbackImpossible naming 202401020000, got %v", err)
+	}
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202401010000 202401020000]" {
+		t.Fatalf("unexpected applied migrations: %v", applied)
+	}
+}
+
+func TestStep(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401030000", "toy"),
+		tableMigration("202401040000", "food"),
+	})
+	assertApplied := func(expected string) {
+		t.Helper()
+		applied, err := migrator.AppliedMigrations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(applied) != expected {
+			t.Fatalf("expected applied migrations %s, got %v", expected, applied)
+		}
+	}
+	
+	if err := migrator.Step(2); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied("[202401010000 202401020000]")
+	if err := migrator.Step(1); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied("[202401010000 202401020000 202401030000]")
+	if err := migrator.Step(-2); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied("[202401010000]")
+	if exist, _ := engine.IsTableExist("pet"); exist {
+		t.Fatal("expected table pet to be dropped")
+	}
+	if err := migrator.Step(0); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied("[202401010000]")
+	
+	// 超过剩余数量时全部运行或回滚
+	if err := migrator.Step(10); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied("[202401010000 202401020000 202401030000 202401040000]")
+	if err := migrator.Step(-10); err != nil {
+		t.Fatal(err)
+	}
+	assertApplied("[]")
+}
+
+func TestRefresh(t *testing.T) {
+	engine := newTestEngine(t)
+	migrations := []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401030000", "toy"),
+	}
+	migrator := New(engine, &Options{}, migrations)
+	if err := migrator.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := engine.Exec("INSERT INTO person (id) VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if count, err := engine.Table("person").Count(); err != nil || count != 0 {
+		t.Fatalf("expected person to be recreated empty, got %d rows, %v", count, err)
+	}
+	if applied, err := migrator.AppliedMigrations(); err != nil || len(applied) != 3 {
+		t.Fatalf("expected all migrations applied, got %v, %v", applied, err)
+	}
+	
+	// 有不能回滚的迁移时不回滚任何迁移
+	migrations[1].Rollback = nil
+	err := migrator.Refresh()
+	if !errors.Is(err, ErrRollbackImpossible) || !strings.Contains(err.Error(), "202401020000") {
+		t.Fatalf("expected ErrRollbackImpossible naming 202401020000, got %v", err)
+	}
+	if exist, _ := engine.IsTableExist("toy"); !exist {
+		t.Fatal("no migration should be rolled back when one cannot be")
+	}
+}
+
+func TestOnSkip(t *testing.T) {
+	engine := newTestEngine(t)
+	var skipped []string
+	options := &Options{
+		OnSkip: func(version string) {
+			skipped = append(skipped, version)
+		},
+	}
+	migrator := New(engine, options, []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401030000", "toy"),
+	})
+	if err := migrator.MigrateTo("202401020000"); err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 0 {
+		t.Fatalf("expected no skipped migrations on the first run, got %v", skipped)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(skipped) != "[202401010000 202401020000]" {
+		t.Fatalf("unexpected skipped migrations: %v", skipped)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	engine := newTestEngine(t)
+	migrator := New(engine, &Options{}, []*Migration{
+		tableMigration("202401010000", "person"),
+		tableMigration("202401020000", "pet"),
+		tableMigration("202401030000", "toy"),
+	})
+	if applied, total, err := migrator.Progress(); err != nil || applied != 0 || total != 3 {
+		t.Fatalf("expected 0/3 without the table, got %d/%d, %v", applied, total, err)
+	}
+	if err := migrator.MigrateTo("202401020000"); err != nil {
+		t.Fatal(err)
+	}
+	if applied, total, err := migrator.Progress(); err != nil || applied != 2 || total != 3 {
+		t.Fatalf("expected 2/3, got %d/%d, %v", applied, total, err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	// 代码中不存在的记录不计算在内
+	if _, err := engine.Exec("INSERT INTO migrations (version) VALUES ('202301010000')"); err != nil {
+		t.Fatal(err)
+	}
+	if applied, total, err := migrator.Progress(); err != nil || applied != 1 || total != 3 {
+		t.Fatalf("expected 1/3, got %d/%d, %v", applied, total, err)
+	}
+}
+
+func TestRecoverPanics(t *testing.T) {
+	engine := newTestEngine(t)
+	panicking := tableMigration("202401020000", "pet")
+	panicking.Migrate = func(*xorm.Engine) error {
+		panic("nil map")
+	}
+	migrations := []*Migration{tableMigration("202401010000", "person"), panicking}
+	migrator := New(engine, &Options{RecoverPanics: true}, migrations)
+	err := migrator.Migrate()
+	if !errors.Is(err, ErrMigrationPanicked) || !strings.Contains(err.Error(), "202401020000: nil map") {
+		t.Fatalf("expected ErrMigrationPanicked with version and value, got %v", err)
+	}
+	if !migrator.tx.IsClosed() {
+		t.Fatal("expected the session to be closed")
+	}
+	// 没有开启LockMigrationsTable时panic之前的迁移记录已经提交
+	applied, err := migrator.appliedVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[202401010000]" {
+		t.Fatalf("expected only the migration before the panic to be recorded, got %v", applied)
+	}
+	
+	// 超时运行在单独的goroutine中, 同样可以恢复
+	err = New(engine, &Options{RecoverPanics: true, MigrationTimeout: time.Minute}, migrations).Migrate()
+	if !errors.Is(err, ErrMigrationPanicked) {
+		t.Fatalf("expected ErrMigrationPanicked with a timeout, got %v", err)
+	}
+	
+	defer func() {
+		if r := recover(); r != "nil map" {
+			t.Fatalf("expected the panic to propagate without RecoverPanics, got %v", r)
+		}
+	}()
+	New(engine, &Options{}, migrations).Migrate()
+}
+
+func TestMigrationLogs(t *testing.T) {
+	engine := newTestEngine(t)
+	person := tableMigration("202401010000", "person")
+	person.Description = "create person"
+	migrations := []*Migration{person, tableMigration("202401020000", "pet")}
+	if err := New(engine, &Options{}, migrations[:1]).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	var logs strings.Builder
+	migrator := New(engine, &Options{}, migrations)
+	migrator.NewLogger(&logs)
+	defer migrator.DefaultLogger()
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"migration 202401010000 has already been applied, skipped",
+		"applying migration 202401020000\n",
+		"applied migration 202401020000 in ",
+		"rolling back migration 202401020000",
+		"rolled back migration 202401020000 in ",
+	} {
+		if !strings.Contains(logs.String(), expected) {
+			t.Fatalf("expected %q in logs, got %q", expected, logs.String())
+		}
+	}
+	
+	logs.Reset()
+	fresh := New(newTestEngine(t), &Options{}, migrations)
+	fresh.InitSchema(func(engine *xorm.Engine) error { return nil })
+	if err := fresh.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "initialized schema in ") {
+		t.Fatalf("expected init schema log, got %q", logs.String())
+	}
+}
+
+func TestUseLockUnsupported(t *testing.T) {
+	engine := newTestEngine(t)
+	var logs strings.Builder
+	migrator := New(engine, &Options{UseLock: true}, []*Migration{tableMigration("202401010000", "person")})
+	migrator.NewLogger(&logs)
+	defer migrator.DefaultLogger()
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(logs.String(), "advisory lock is not supported by sqlite3") {
+		t.Fatalf("expected warning for unsupported driver, got %q", logs.String())
+	}
+	if exist, _ := engine.IsTableExist("person"); !exist {
+		t.Fatal("expected migrations to run without the lock")
+	}
+}
+
+func TestModelColumnTypes(t *testing.T) {
+	engine, err := xorm.NewEngine("mysql", "user:password@tcp(127.0.0.1:3306)/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	migrator := New(engine, &Options{}, nil)
+	table := engine.TableInfo(migrator.model())
+	ddl := engine.Dialect().CreateTableSql(table.Table, DefaultOptions.TableName, "", "")
+	for _, expected := range []string{"`id` BIGINT(20) PRIMARY KEY AUTO_INCREMENT", "`is_rollback` TINYINT(1) DEFAULT 0", "`description` VARCHAR(255)"} {
+		if !strings.Contains(ddl, expected) {
+			t.Fatalf("expected %q in MySQL DDL:\n%s", expected, ddl)
+		}
+	}
+	
+	if types := columnTypesFor(core.POSTGRES); types.id != "bigint" || types.flag != "smallint" || types.text(255) != "text" {
+		t.Fatalf("unexpected PostgreSQL column types: %+v", types)
+	}
+	
+	sqlite := newTestEngine(t)
+	if err := New(sqlite, &Options{}, []*Migration{tableMigration("202401010000", "person")}).Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	tables, err := sqlite.DBMetas()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tb := range tables {
+		if tb.Name != DefaultOptions.TableName {
+			continue
+		}
+		for column, expected := range map[string]string{"id": core.Integer, "is_rollback": core.Integer, "description": core.Text} {
+			if got := tb.GetColumn(column).SQLType.Name; got != expected {
+				t.Fatalf("column %s: expected %s, got %s", column, expected, got)
+			}
+		}
+	}
 }
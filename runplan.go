@@ -0,0 +1,110 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// StaleRunPlan 上一次没有成功完成的运行留下的执行计划
+type StaleRunPlan struct {
+	// StartedAt 上一次运行开始的时间
+	StartedAt time.Time
+	// Versions 上一次运行打算执行的迁移, 按执行顺序
+	Versions []string
+	// Applied Versions中已经记录为运行过的迁移
+	Applied []string
+	// Remaining Versions中尚未运行的迁移, 第一个即上一次运行中断的位置
+	Remaining []string
+}
+
+// runPlanRecord 执行计划表的记录
+type runPlanRecord struct {
+	ID        int64     `xorm:"pk autoincr 'id'"`
+	Versions  string    `xorm:"text 'versions'"`
+	StartedAt time.Time `xorm:"datetime 'started_at'"`
+}
+
+// runPlanTableName 返回执行计划表名, 默认为迁移表名加"_run_plan"
+func (x *XorMigrate) runPlanTableName() string {
+	if x.options.RunPlanTableName != "" {
+		return x.options.RunPlanTableName
+	}
+	return x.options.TableName + "_run_plan"
+}
+
+// StaleRunPlan 返回上一次没有成功完成的运行留下的执行计划, 没有时返回nil
+func (x *XorMigrate) StaleRunPlan() (*StaleRunPlan, error) {
+	exist, err := x.db.IsTableExist(x.runPlanTableName())
+	if err != nil || !exist {
+		return nil, err
+	}
+	var records []runPlanRecord
+	if err := x.db.Table(x.runPlanTableName()).Asc("id").Find(&records); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	
+	record := records[len(records)-1]
+	plan := &StaleRunPlan{
+		StartedAt: record.StartedAt,
+		Versions:  strings.Split(record.Versions, "\n"),
+	}
+	applied, err := x.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	appliedSet := make(map[string]struct{}, len(applied))
+	for _, version := range applied {
+		appliedSet[version] = struct{}{}
+	}
+	for _, version := range plan.Versions {
+		if _, ok := appliedSet[version]; ok {
+			plan.Applied = append(plan.Applied, version)
+		} else {
+			plan.Remaining = append(plan.Remaining, version)
+		}
+	}
+	return plan, nil
+}
+
+// startRunPlan 报告上一次运行留下的执行计划, 然后记录本次运行将要执行的迁移
+func (x *XorMigrate) startRunPlan(versions []string) error {
+	if err := x.tx.Table(x.runPlanTableName()).Sync2(new(runPlanRecord)); err != nil {
+		return err
+	}
+	stale, err := x.StaleRunPlan()
+	if err != nil {
+		return err
+	}
+	if stale != nil {
+		if x.options.OnStaleRunPlan != nil {
+			if err := x.options.OnStaleRunPlan(stale); err != nil {
+				return err
+			}
+		} else {
+			logger.Warnf("previous run started at %s did not finish, applied %v, remaining %v",
+				stale.StartedAt.Format(time.RFC3339), stale.Applied, stale.Remaining)
+		}
+	}
+	
+	if err := x.clearRunPlan(); err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return nil
+	}
+	_, err = x.tx.Table(x.runPlanTableName()).Insert(&runPlanRecord{
+		Versions:  strings.Join(versions, "\n"),
+		StartedAt: time.Now(),
+	})
+	return err
+}
+
+// clearRunPlan 删除执行计划, 运行成功时调用
+func (x *XorMigrate) clearRunPlan() error {
+	_, err := x.tx.Exec(fmt.Sprintf("DELETE FROM %s", x.db.Quote(x.runPlanTableName())))
+	return err
+}
@@ -0,0 +1,359 @@
+package migrate
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	
+	"github.com/go-xorm/xorm"
+)
+
+const (
+	// SQL迁移文件后缀, 例如 202307241038_person.up.sql / 202307241038_person.down.sql
+	sqlUpSuffix   = ".up.sql"
+	sqlDownSuffix = ".down.sql"
+	// ManifestFileName 可选的清单文件, 每行一个up文件名, 决定迁移的顺序和范围
+	ManifestFileName = "migrations.manifest"
+)
+
+// SQLLoaderOptions 控制SQL文件如何拆分为语句执行
+type SQLLoaderOptions struct {
+	// Separator 语句分隔符, 默认";"
+	// 由字母组成的分隔符(例如SQL Server的"GO")只有单独成行时才生效
+	Separator string
+	// StripComments 执行前去掉"--"和"/* */"注释
+	StripComments bool
+	// Vars 替换SQL中的${VAR}占位符, 只会使用这里列出的变量
+	Vars map[string]string
+	// ExpandEnv Vars中没有的占位符从环境变量中读取, 环境变量可能不可信, 需要显式开启
+	ExpandEnv bool
+}
+
+// sqlVarRegexp 匹配 ${VAR}, 不匹配PostgreSQL的$1参数和$$字符串
+var sqlVarRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// DefaultSQLLoaderOptions 默认
+var DefaultSQLLoaderOptions = &SQLLoaderOptions{
+	Separator:     ";",
+	StripComments: false,
+}
+
+// FromSQLDir 从目录中读取SQL迁移文件并创建XorMigrate
+func FromSQLDir(engine *xorm.Engine, options *Options, dir string, loaderOptions ...*SQLLoaderOptions) (*XorMigrate, error) {
+	return FromFS(engine, options, os.DirFS(dir), ".", loaderOptions...)
+}
+
+// FromFS 从fs.FS(例如embed.FS)中读取SQL迁移文件并创建XorMigrate
+// 存在migrations.manifest时按清单顺序加载, 否则按version排序, 比较方式见Options.VersionLess
+func FromFS(engine *xorm.Engine, options *Options, fsys fs.FS, root string, loaderOptions ...*SQLLoaderOptions) (*XorMigrate, error) {
+	opts := DefaultSQLLoaderOptions
+	if len(loaderOptions) > 0 && loaderOptions[0] != nil {
+		opts = loaderOptions[0]
+	}
+	separator := options.SuffixSeparator
+	if separator == "" {
+		separator = DefaultOptions.SuffixSeparator
+	}
+	less := sortLess(&Options{SuffixSeparator: separator, VersionLess: options.VersionLess})
+	migrations, err := loadSQLMigrations(fsys, root, opts, less)
+	if err != nil {
+		return nil, err
+	}
+	return New(engine, options, migrations), nil
+}
+
+// loadSQLMigrations 读取root中的SQL迁移文件, 没有清单时按less排序
+func loadSQLMigrations(fsys fs.FS, root string, opts *SQLLoaderOptions, less func(a, b string) bool) ([]*Migration, error) {
+	entries, err := fs.ReadDir(fsys, root)
+	if err != nil {
+		return nil, err
+	}
+	
+	ups := make(map[string]string)
+	downs := make(map[string]string)
+	hasManifest := false
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name := entry.Name()
+		switch {
+		case name == ManifestFileName:
+			hasManifest = true
+		case strings.HasSuffix(name, sqlUpSuffix):
+			ups[strings.TrimSuffix(name, sqlUpSuffix)] = name
+		case strings.HasSuffix(name, sqlDownSuffix):
+			downs[strings.TrimSuffix(name, sqlDownSuffix)] = name
+		}
+	}
+	
+	for version, name := range downs {
+		if _, ok := ups[version]; !ok {
+			return nil, fmt.Errorf("xormigrate: %s has no matching up file", name)
+		}
+	}
+	
+	var files []string
+	if hasManifest {
+		files, err = readManifest(fsys, path.Join(root, ManifestFileName), ups)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, name := range ups {
+			files = append(files, name)
+		}
+		sort.Slice(files, func(i, j int) bool {
+			return less(strings.TrimSuffix(files[i], sqlUpSuffix), strings.TrimSuffix(files[j], sqlUpSuffix))
+		})
+	}
+	
+	migrations := make([]*Migration, 0, len(files))
+	for _, name := range files {
+		version := strings.TrimSuffix(name, sqlUpSuffix)
+		up, upRaw, err := readSQLFile(fsys, root, name, opts)
+		if err != nil {
+			return nil, err
+		}
+		migration := &Migration{
+			Version:    version,
+			Migrate:    execSQL(up),
+			Source:     name,
+			statements: up,
+		}
+		var downRaw string
+		if downName, ok := downs[version]; ok {
+			var down []string
+			if down, downRaw, err = readSQLFile(fsys, root, downName, opts); err != nil {
+				return nil, err
+			}
+			migration.Rollback = execSQL(down)
+			migration.RollbackSQL = down
+		}
+		migration.Checksum = sqlChecksum(upRaw, downRaw)
+		migrations = append(migrations, migration)
+	}
+	return migrations, nil
+}
+
+// readSQLFile 读取SQL文件, 替换变量后拆分为语句, 同时返回替换前的原始内容
+func readSQLFile(fsys fs.FS, root, name string, opts *SQLLoaderOptions) ([]string, string, error) {
+	data, err := fs.ReadFile(fsys, path.Join(root, name))
+	if err != nil {
+		return nil, "", err
+	}
+	query, err := expandSQLVars(string(data), opts)
+	if err != nil {
+		return nil, "", fmt.Errorf("xormigrate: %s: %w", name, err)
+	}
+	return splitStatements(query, opts), string(data), nil
+}
+
+// expandSQLVars 替换${VAR}占位符, 未定义的变量返回错误
+// 没有设置Vars且没有开启ExpandEnv时不做替换
+func expandSQLVars(query string, opts *SQLLoaderOptions) (string, error) {
+	if len(opts.Vars) == 0 && !opts.ExpandEnv {
+		return query, nil
+	}
+	var err error
+	query = sqlVarRegexp.ReplaceAllStringFunc(query, func(match string) string {
+		key := sqlVarRegexp.FindStringSubmatch(match)[1]
+		if value, ok := opts.Vars[key]; ok {
+			return value
+		}
+		if opts.ExpandEnv {
+			if value, ok := os.LookupEnv(key); ok {
+				return value
+			}
+		}
+		if err == nil {
+			err = fmt.Errorf("undefined variable %s", match)
+		}
+		return match
+	})
+	return query, err
+}
+
+// readManifest 读取清单文件, 空行和#开头的行会被忽略
+// 清单中的文件必须存在, 目录中的up文件也必须出现在清单中
+func readManifest(fsys fs.FS, name string, ups map[string]string) ([]string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	
+	var files []string
+	listed := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, ok := listed[line]; ok {
+			return nil, fmt.Errorf("xormigrate: %s is listed more than once in %s", line, ManifestFileName)
+		}
+		if ups[strings.TrimSuffix(line, sqlUpSuffix)] != line {
+			return nil, fmt.Errorf("xormigrate: %s is listed in %s but does not exist", line, ManifestFileName)
+		}
+		listed[line] = struct{}{}
+		files = append(files, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	
+	for _, name := range ups {
+		if _, ok := listed[name]; !ok {
+			return nil, fmt.Errorf("xormigrate: %s is not listed in %s", name, ManifestFileName)
+		}
+	}
+	return files, nil
+}
+
+// splitStatements 按分隔符拆分SQL, 忽略字符串和注释中的分隔符
+func splitStatements(query string, opts *SQLLoaderOptions) []string {
+	separator := opts.Separator
+	if separator == "" {
+		separator = DefaultSQLLoaderOptions.Separator
+	}
+	lineSeparator := strings.IndexFunc(separator, func(r rune) bool {
+		return !unicode.IsLetter(r)
+	}) < 0
+	
+	var (
+		statements []string
+		current    strings.Builder
+		// 当前语句是否包含注释以外的内容, 只有注释的语句不执行
+		hasCode bool
+		// 当前所在字符串的引号, 0表示不在字符串中
+		quote byte
+	)
+	flush := func() {
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(current.String()))
+		}
+		current.Reset()
+		hasCode = false
+	}
+	
+	for i := 0; i < len(query); {
+		c := query[i]
+		switch {
+		case quote != 0:
+			current.WriteByte(c)
+			i++
+			if c == quote {
+				// 连续两个引号是转义
+				if i < len(query) && query[i] == quote {
+					current.WriteByte(c)
+					i++
+				} else {
+					quote = 0
+				}
+			}
+		case lineSeparator && (i == 0 || query[i-1] == '\n') && strings.EqualFold(strings.TrimSpace(lineAt(query, i)), separator):
+			flush()
+			i += len(lineAt(query, i))
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			hasCode = true
+			current.WriteByte(c)
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			end := i + len(lineAt(query, i))
+			if !opts.StripComments {
+				current.WriteString(query[i:end])
+			}
+			i = end
+		case strings.HasPrefix(query[i:], "/*"):
+			end := len(query)
+			if n := strings.Index(query[i+2:], "*/"); n >= 0 {
+				end = i + 2 + n + 2
+			}
+			if !opts.StripComments {
+				current.WriteString(query[i:end])
+			}
+			i = end
+		case !lineSeparator && strings.HasPrefix(query[i:], separator):
+			flush()
+			i += len(separator)
+		default:
+			if !unicode.IsSpace(rune(c)) {
+				hasCode = true
+			}
+			current.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	return statements
+}
+
+// lineAt 返回从i开始到行尾(不含换行符)的内容
+func lineAt(query string, i int) string {
+	if n := strings.IndexByte(query[i:], '\n'); n >= 0 {
+		return query[i : i+n]
+	}
+	return query[i:]
+}
+
+// sqlChecksum 计算up和down文件原始内容(替换变量前)的SHA-256, 不同环境的Vars不会改变校验值
+// 计算前统一换行符并合并字符串以外的连续空白字符, 只调整格式不会改变校验值
+func sqlChecksum(up, down string) string {
+	h := sha256.New()
+	for _, query := range []string{up, down} {
+		fmt.Fprintf(h, "%s\x00", normalizeSQL(query))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeSQL 统一换行符, 字符串以外的连续空白字符合并为一个空格, 字符串中的内容保持不变
+func normalizeSQL(query string) string {
+	query = strings.ReplaceAll(query, "\r\n", "\n")
+	var (
+		b     strings.Builder
+		quote byte
+		space bool
+	)
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			space = true
+			continue
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+func execSQL(statements []string) func(engine *xorm.Engine) error {
+	return func(engine *xorm.Engine) error {
+		for _, statement := range statements {
+			if _, err := engine.Exec(statement); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,424 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func versionsOf(migrations []*Migration) []string {
+	versions := make([]string, 0, len(migrations))
+	for _, m := range migrations {
+		versions = append(versions, m.Version)
+	}
+	return versions
+}
+
+func TestLoadSQLMigrationsSortedByFilename(t *testing.T) {
+	fsys := fstest.MapFS{
+		"sql/202307241042_person.up.sql":   {Data: []byte("ALTER TABLE person ADD COLUMN a varchar(255)")},
+		"sql/202307241038_person.up.sql":   {Data: []byte("CREATE TABLE person (name varchar(255))")},
+		"sql/202307241038_person.down.sql": {Data: []byte("DROP TABLE person")},
+		"sql/README.md":                    {Data: []byte("ignored")},
+	}
+	migrations, err := loadSQLMigrations(fsys, "sql", DefaultSQLLoaderOptions, sortLess(&Options{SuffixSeparator: "_"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(versionsOf(migrations), ","); got != "202307241038_person,202307241042_person" {
+		t.Fatalf("unexpected order: %s", got)
+	}
+	if migrations[0].Rollback == nil {
+		t.Fatal("expected rollback for 202307241038_person")
+	}
+	if migrations[1].Rollback != nil {
+		t.Fatal("expected nil rollback for 202307241042_person")
+	}
+	if migrations[1].Source != "202307241042_person.up.sql" {
+		t.Fatalf("unexpected source: %s", migrations[1].Source)
+	}
+}
+
+func TestLoadSQLMigrationsSameTimestamp(t *testing.T) {
+	fsys := fstest.MapFS{
+		"202307241038-toy.up.sql":     {Data: []byte("SELECT 1")},
+		"202307241038-pet.up.sql":     {Data: []byte("SELECT 1")},
+		"202307241038-person.up.sql":  {Data: []byte("SELECT 1")},
+		"20230724103-legacy.up.sql":   {Data: []byte("SELECT 1")},
+		"202307241039-account.up.sql": {Data: []byte("SELECT 1")},
+	}
+	for i := 0; i < 10; i++ {
+		migrations, err := loadSQLMigrations(fsys, ".", DefaultSQLLoaderOptions, sortLess(&Options{SuffixSeparator: "-"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "20230724103-legacy,202307241038-person,202307241038-pet,202307241038-toy,202307241039-account"
+		if got := strings.Join(versionsOf(migrations), ","); got != expected {
+			t.Fatalf("unexpected order: %s", got)
+		}
+	}
+}
+
+func TestLoadSQLMigrationsWithManifest(t *testing.T) {
+	fsys := fstest.MapFS{
+		"b.up.sql": {Data: []byte("SELECT 1")},
+		"a.up.sql": {Data: []byte("SELECT 1")},
+		"c.up.sql": {Data: []byte("SELECT 1")},
+		ManifestFileName: {Data: []byte(`# deliberately reordered
+c.up.sql
+
+a.up.sql
+b.up.sql
+`)},
+	}
+	migrations, err := loadSQLMigrations(fsys, ".", DefaultSQLLoaderOptions, sortLess(&Options{SuffixSeparator: "_"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(versionsOf(migrations), ","); got != "c,a,b" {
+		t.Fatalf("unexpected order: %s", got)
+	}
+}
+
+func TestLoadSQLMigrationsManifestErrors(t *testing.T) {
+	tests := map[string]fstest.MapFS{
+		"missing file": {
+			"a.up.sql":       {Data: []byte("SELECT 1")},
+			ManifestFileName: {Data: []byte("a.up.sql\nb.up.sql\n")},
+		},
+		"unlisted file": {
+			"a.up.sql":       {Data: []byte("SELECT 1")},
+			"b.up.sql":       {Data: []byte("SELECT 1")},
+			ManifestFileName: {Data: []byte("a.up.sql\n")},
+		},
+		"duplicated entry": {
+			"a.up.sql":       {Data: []byte("SELECT 1")},
+			ManifestFileName: {Data: []byte("a.up.sql\na.up.sql\n")},
+		},
+	}
+	for name, fsys := range tests {
+		if _, err := loadSQLMigrations(fsys, ".", DefaultSQLLoaderOptions, sortLess(&Options{SuffixSeparator: "_"})); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoadSQLMigrationsOrphanDown(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.down.sql": {Data: []byte("SELECT 1")},
+	}
+	if _, err := loadSQLMigrations(fsys, ".", DefaultSQLLoaderOptions, sortLess(&Options{SuffixSeparator: "_"})); err == nil {
+		t.Fatal("expected an error for a down file without up file")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		opts       *SQLLoaderOptions
+		statements []string
+	}{
+		{
+			name:       "default separator",
+			query:      "CREATE TABLE a (id int);\nINSERT INTO a VALUES (1);\n",
+			opts:       DefaultSQLLoaderOptions,
+			statements: []string{"CREATE TABLE a (id int)", "INSERT INTO a VALUES (1)"},
+		},
+		{
+			name:       "separator in string literal",
+			query:      `INSERT INTO a VALUES ('x;y'); INSERT INTO a VALUES ('it''s;')`,
+			opts:       DefaultSQLLoaderOptions,
+			statements: []string{`INSERT INTO a VALUES ('x;y')`, `INSERT INTO a VALUES ('it''s;')`},
+		},
+		{
+			name:       "double semicolon",
+			query:      "CREATE TRIGGER t AFTER INSERT ON a BEGIN SELECT 1; END;;\nSELECT 2;;",
+			opts:       &SQLLoaderOptions{Separator: ";;"},
+			statements: []string{"CREATE TRIGGER t AFTER INSERT ON a BEGIN SELECT 1; END", "SELECT 2"},
+		},
+		{
+			name:       "GO on its own line",
+			query:      "CREATE TABLE goals (id int)\nGO\nINSERT INTO goals VALUES (1)\ngo\n",
+			opts:       &SQLLoaderOptions{Separator: "GO"},
+			statements: []string{"CREATE TABLE goals (id int)", "INSERT INTO goals VALUES (1)"},
+		},
+		{
+			name:       "keep comments",
+			query:      "-- create a; table\nCREATE TABLE a (id int); /* trailing; */",
+			opts:       DefaultSQLLoaderOptions,
+			statements: []string{"-- create a; table\nCREATE TABLE a (id int)"},
+		},
+		{
+			name:       "strip comments",
+			query:      "-- create a; table\nCREATE TABLE a (id int /* pk; */); /* trailing; */",
+			opts:       &SQLLoaderOptions{StripComments: true},
+			statements: []string{"CREATE TABLE a (id int )"},
+		},
+	}
+	for _, tt := range tests {
+		got := splitStatements(tt.query, tt.opts)
+		if strings.Join(got, "|") != strings.Join(tt.statements, "|") {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.statements, got)
+		}
+	}
+}
+
+func TestFromFSWithSeparator(t *testing.T) {
+	engine := newTestEngine(t)
+	fsys := fstest.MapFS{
+		"202307241038_person.up.sql": {Data: []byte(`-- person table
+CREATE TABLE person (name varchar(255))
+GO
+INSERT INTO person (name) VALUES ('a;b')
+GO
+`)},
+		"202307241038_person.down.sql": {Data: []byte("DROP TABLE person\nGO\n")},
+	}
+	migrator, err := FromFS(engine, &Options{}, fsys, ".", &SQLLoaderOptions{Separator: "GO", StripComments: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	count, err := engine.Table("person").Where("name = ?", "a;b").Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 person, got %d", count)
+	}
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	exist, err := engine.IsTableExist("person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exist {
+		t.Fatal("expected person table to be dropped")
+	}
+}
+
+func TestFromFSWithVars(t *testing.T) {
+	engine := newTestEngine(t)
+	fsys := fstest.MapFS{
+		"202307241038_person.up.sql":   {Data: []byte("CREATE TABLE ${PREFIX}person (name varchar(255))")},
+		"202307241038_person.down.sql": {Data: []byte("DROP TABLE ${PREFIX}person")},
+	}
+	migrator, err := FromFS(engine, &Options{}, fsys, ".", &SQLLoaderOptions{Vars: map[string]string{"PREFIX": "app_"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := engine.IsTableExist("app_person"); !exist {
+		t.Fatal("expected app_person table to be created")
+	}
+	
+	// 不在Vars中的变量即使存在同名环境变量也不会替换
+	t.Setenv("PREFIX", "env_")
+	_, err = FromFS(engine, &Options{}, fsys, ".", &SQLLoaderOptions{Vars: map[string]string{"OTHER": "x"}})
+	if err == nil || !strings.Contains(err.Error(), "undefined variable ${PREFIX}") {
+		t.Fatalf("expected undefined variable error, got %v", err)
+	}
+	if _, err := FromFS(engine, &Options{}, fsys, ".", &SQLLoaderOptions{ExpandEnv: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRollbackStored(t *testing.T) {
+	engine := newTestEngine(t)
+	fsys := fstest.MapFS{
+		"202307241038_person.up.sql":   {Data: []byte("CREATE TABLE person (name varchar(255));")},
+		"202307241038_person.down.sql": {Data: []byte("DROP TABLE person;")},
+	}
+	migrator, err := FromFS(engine, &Options{StoreRollbackSQL: true}, fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	
+	// 另一个程序中没有该迁移的定义
+	other := New(engine, &Options{}, nil)
+	if err := other.RollbackStored("202307241038_person"); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("expected person table to be dropped by stored rollback")
+	}
+	if err := other.RollbackStored("202307241038_person"); !errors.Is(err, ErrNoStoredRollback) {
+		t.Fatalf("expected ErrNoStoredRollback after rollback, got %v", err)
+	}
+}
+
+func TestSQLChecksum(t *testing.T) {
+	load := func(up, down string) string {
+		fsys := fstest.MapFS{
+			"202307241038_person.up.sql":   {Data: []byte(up)},
+			"202307241038_person.down.sql": {Data: []byte(down)},
+		}
+		migrations, err := loadSQLMigrations(fsys, ".", DefaultSQLLoaderOptions, sortLess(&Options{SuffixSeparator: "_"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return migrations[0].Checksum
+	}
+	checksum := load("CREATE TABLE person (name varchar(255));", "DROP TABLE person;")
+	if checksum == "" {
+		t.Fatal("expected checksum to be computed")
+	}
+	if reformatted := load("CREATE   TABLE\r\n\tperson (name varchar(255));\r\n", "DROP  TABLE person;\n\n"); reformatted != checksum {
+		t.Fatalf("whitespace changes should not change the checksum: %s != %s", reformatted, checksum)
+	}
+	if changed := load("CREATE TABLE person (name varchar(64));", "DROP TABLE person;"); changed == checksum {
+		t.Fatal("changing the up SQL should change the checksum")
+	}
+	if changed := load("CREATE TABLE person (name varchar(255));", "DROP TABLE IF EXISTS person;"); changed == checksum {
+		t.Fatal("changing the down SQL should change the checksum")
+	}
+	
+	// 字符串中的空白字符是内容的一部分
+	insert := load("INSERT INTO person (name) VALUES ('a b');", "")
+	if changed := load("INSERT INTO person (name) VALUES ('a  b');", ""); changed == insert {
+		t.Fatal("changing whitespace inside a string literal should change the checksum")
+	}
+	if reformatted := load("INSERT  INTO person (name)\r\nVALUES ('a b');", ""); reformatted != insert {
+		t.Fatal("whitespace outside string literals should not change the checksum")
+	}
+}
+
+func TestSQLChecksumIgnoresVars(t *testing.T) {
+	fsys := fstest.MapFS{
+		"202307241038_person.up.sql": {Data: []byte("CREATE TABLE ${PREFIX}person (name varchar(255));")},
+	}
+	load := func(prefix string) *Migration {
+		opts := *DefaultSQLLoaderOptions
+		opts.Vars = map[string]string{"PREFIX": prefix}
+		migrations, err := loadSQLMigrations(fsys, ".", &opts, sortLess(&Options{SuffixSeparator: "_"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return migrations[0]
+	}
+	staging, production := load("staging_"), load("prod_")
+	if staging.statements[0] == production.statements[0] {
+		t.Fatal("expected variables to be expanded in the statements")
+	}
+	if staging.Checksum != production.Checksum {
+		t.Fatalf("variables should not change the checksum: %s != %s", staging.Checksum, production.Checksum)
+	}
+}
+
+func TestFromSQLDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"202307241038_person.up.sql":   "CREATE TABLE person (name varchar(255));",
+		"202307241038_person.down.sql": "DROP TABLE person;",
+		"202307241042_pet.up.sql":      "CREATE TABLE pet (name varchar(255));",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	
+	engine := newTestEngine(t)
+	migrator, err := FromSQLDir(engine, &Options{}, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"person", "pet"} {
+		if exist, _ := engine.IsTableExist(table); !exist {
+			t.Fatalf("expected table %s to be created", table)
+		}
+	}
+	// 没有down文件的迁移不能回滚
+	if err := migrator.RollbackLast(); !errors.Is(err, ErrRollbackImpossible) {
+		t.Fatalf("expected ErrRollbackImpossible, got %v", err)
+	}
+	if err := migrator.RollbackMigration(migrator.migrations[0]); err != nil {
+		t.Fatal(err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("expected person table to be dropped by the down file")
+	}
+}
+
+func TestSingleDDLPerMigration(t *testing.T) {
+	engine := newTestEngine(t)
+	fsys := fstest.MapFS{
+		"202307241038_person.up.sql": {Data: []byte("CREATE TABLE person (name varchar(255));\nINSERT INTO person (name) VALUES ('a');")},
+		"202307241039_pet.up.sql":    {Data: []byte("CREATE TABLE pet (name varchar(255));\n-- owner\nalter table pet add column owner varchar(255);")},
+	}
+	migrator, err := FromFS(engine, &Options{SingleDDLPerMigration: true}, fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = migrator.Migrate()
+	if !errors.Is(err, ErrMultipleDDL) || !strings.Contains(err.Error(), "202307241039_pet (2 statements)") {
+		t.Fatalf("expected ErrMultipleDDL naming 202307241039_pet, got %v", err)
+	}
+	if strings.Contains(err.Error(), "202307241038_person") {
+		t.Fatalf("DML should not be counted as DDL: %v", err)
+	}
+	if exist, _ := engine.IsTableExist("person"); exist {
+		t.Fatal("no migration should run when validation fails")
+	}
+	
+	// Content也会被检查
+	content := &Migration{
+		Version: "202307241040",
+		Content: "DROP TABLE a; DROP TABLE b",
+	}
+	if n := len(content.ddlStatements()); n != 2 {
+		t.Fatalf("expected 2 DDL statements in Content, got %d", n)
+	}
+}
+
+func TestFromFSVersionLess(t *testing.T) {
+	fsys := fstest.MapFS{
+		"1.10.0_toy.up.sql":   {Data: []byte("CREATE TABLE toy (id INTEGER);")},
+		"1.2.10_pet.up.sql":   {Data: []byte("CREATE TABLE pet (id INTEGER);")},
+		"1.2.9_person.up.sql": {Data: []byte("CREATE TABLE person (id INTEGER);")},
+	}
+	// 按语义化版本比较_之前的部分
+	semverLess := func(a, b string) bool {
+		pa := strings.Split(strings.SplitN(a, "_", 2)[0], ".")
+		pb := strings.Split(strings.SplitN(b, "_", 2)[0], ".")
+		for i := 0; i < len(pa) && i < len(pb); i++ {
+			na, _ := strconv.Atoi(pa[i])
+			nb, _ := strconv.Atoi(pb[i])
+			if na != nb {
+				return na < nb
+			}
+		}
+		return len(pa) < len(pb)
+	}
+	migrator, err := FromFS(newTestEngine(t), &Options{ValidateOrder: true, VersionLess: semverLess}, fsys, ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[1.2.9_person 1.2.10_pet 1.10.0_toy]" {
+		t.Fatalf("expected files to be loaded in VersionLess order, got %v", applied)
+	}
+}
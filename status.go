@@ -0,0 +1,450 @@
+package migrate
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// ReconcileEntry 对账报告中的一条迁移
+type ReconcileEntry struct {
+	Version string
+	// Description 代码中定义的描述, 代码中没有定义的迁移使用迁移表中记录的描述
+	Description string
+	// Skipped 迁移被记录为已运行, 但实际通过SkipIf或ErrSkipMigration跳过
+	Skipped bool
+	// SkipReason 跳过的原因
+	SkipReason string
+	// MigratedAt 迁移表中记录的运行时间, 从未运行时为零值
+	MigratedAt time.Time
+	// RolledBackAt 回滚时间, 只有运行后又回滚的待运行迁移不为零值
+	RolledBackAt time.Time
+}
+
+// ReconcileReport 代码中定义的迁移与数据库中记录的对比
+type ReconcileReport struct {
+	// Pending 代码中定义但尚未运行, 按代码中的顺序
+	Pending []ReconcileEntry
+	// Unknown 数据库中已运行但代码中没有定义, 按运行顺序
+	Unknown []ReconcileEntry
+	// Applied 代码中定义且已运行, 按代码中的顺序
+	Applied []ReconcileEntry
+}
+
+// Reconcile 返回代码中定义的迁移与数据库中已运行的迁移的对比, 不会修改数据库
+func (x *XorMigrate) Reconcile() (*ReconcileReport, error) {
+	applied, err := x.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	appliedSet := make(map[string]struct{}, len(applied))
+	for _, version := range applied {
+		appliedSet[version] = struct{}{}
+	}
+	skipped, err := x.skippedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	records, err := x.storedRecords()
+	if err != nil {
+		return nil, err
+	}
+	
+	report := &ReconcileReport{}
+	declared := make(map[string]struct{}, len(x.migrations))
+	for _, migration := range x.migrations {
+		declared[migration.Version] = struct{}{}
+		record := records[migration.Version]
+		entry := ReconcileEntry{
+			Version:      migration.Version,
+			Description:  migration.Description,
+			MigratedAt:   record.MigratedAt,
+			RolledBackAt: record.RolledBackAt,
+		}
+		if _, ok := appliedSet[migration.Version]; ok {
+			entry.SkipReason, entry.Skipped = skipped[migration.Version]
+			report.Applied = append(report.Applied, entry)
+		} else {
+			report.Pending = append(report.Pending, entry)
+		}
+	}
+	for _, version := range applied {
+		if _, ok := declared[version]; !ok {
+			reason, ok := skipped[version]
+			record := records[version]
+			report.Unknown = append(report.Unknown, ReconcileEntry{
+				Version:     version,
+				Description: record.Description,
+				Skipped:     ok,
+				SkipReason:  reason,
+				MigratedAt:  record.MigratedAt,
+			})
+		}
+	}
+	return report, nil
+}
+
+// MigrationStatus 一个迁移在代码和数据库中的状态
+type MigrationStatus struct {
+	Version string
+	// Applied 已运行且未回滚
+	Applied bool
+	// RolledBack 运行过但已回滚
+	RolledBack bool
+	// InCode 代码中定义了该迁移, 为false时只存在于数据库中
+	InCode bool
+	// Skipped 已运行的迁移实际通过SkipIf或ErrSkipMigration跳过
+	Skipped bool
+	// SkipReason 跳过的原因
+	SkipReason string
+}
+
+// Status 返回所有迁移的状态, 先按代码中的顺序列出定义的迁移, 再按运行顺序列出只存在于数据库中的迁移
+// 不会修改数据库, 迁移表不存在时所有迁移都未运行
+func (x *XorMigrate) Status() ([]MigrationStatus, error) {
+	var rows []map[string]string
+	exist, err := x.migrationTableExists()
+	if err != nil {
+		return nil, err
+	}
+	if exist {
+		rows, err = x.db.
+			Table(x.options.TableName).
+			Cols(x.options.VersionColumnName, x.options.RollbackColumnName).
+			Asc(x.recordOrder()...).
+			QueryString()
+		if err != nil {
+			return nil, err
+		}
+	}
+	skipped, err := x.skippedMigrations()
+	if err != nil {
+		return nil, err
+	}
+	
+	stored := make(map[string]*MigrationStatus, len(rows))
+	var storedOrder []string
+	for _, row := range rows {
+		version := row[x.options.VersionColumnName]
+		if isInternalVersion(version) {
+			continue
+		}
+		status, ok := stored[version]
+		if !ok {
+			status = &MigrationStatus{Version: version}
+			stored[version] = status
+			storedOrder = append(storedOrder, version)
+		}
+		if row[x.options.RollbackColumnName] == "0" {
+			status.Applied = true
+			status.SkipReason, status.Skipped = skipped[version]
+		} else {
+			status.RolledBack = true
+		}
+	}
+	
+	statuses := make([]MigrationStatus, 0, len(x.migrations)+len(storedOrder))
+	for _, migration := range x.migrations {
+		status := MigrationStatus{Version: migration.Version, InCode: true}
+		if s, ok := stored[migration.Version]; ok {
+			status.Applied = s.Applied
+			status.RolledBack = s.RolledBack && !s.Applied
+			status.Skipped, status.SkipReason = s.Skipped, s.SkipReason
+			s.InCode = true
+		}
+		statuses = append(statuses, status)
+	}
+	for _, version := range storedOrder {
+		if s := stored[version]; !s.InCode {
+			s.RolledBack = s.RolledBack && !s.Applied
+			statuses = append(statuses, *s)
+		}
+	}
+	return statuses, nil
+}
+
+// PlanStatus 迁移计划中迁移的处理方式
+type PlanStatus string
+
+const (
+	// PlanApply 尚未运行, Migrate时会运行
+	PlanApply PlanStatus = "APPLY"
+	// PlanSkip 已经运行, Migrate时跳过
+	PlanSkip PlanStatus = "SKIP"
+	// PlanOrphan 数据库中已运行但代码中没有定义
+	PlanOrphan PlanStatus = "ORPHAN"
+)
+
+// PlanEntry 迁移计划中的一条迁移
+type PlanEntry struct {
+	Version     string
+	Description string
+	Status      PlanStatus
+}
+
+// PrintPlan 中描述的最大显示宽度, 超出部分截断
+const planDescriptionWidth = 50
+
+// Plan 按代码中的顺序返回每个迁移在Migrate时的处理方式, 代码中没有定义的已运行迁移排在最后
+func (x *XorMigrate) Plan() ([]PlanEntry, error) {
+	report, err := x.Reconcile()
+	if err != nil {
+		return nil, err
+	}
+	pending := make(map[string]struct{}, len(report.Pending))
+	for _, entry := range report.Pending {
+		pending[entry.Version] = struct{}{}
+	}
+	plan := make([]PlanEntry, 0, len(x.migrations)+len(report.Unknown))
+	for _, migration := range x.migrations {
+		status := PlanSkip
+		if _, ok := pending[migration.Version]; ok {
+			status = PlanApply
+		}
+		plan = append(plan, PlanEntry{Version: migration.Version, Description: migration.Description, Status: status})
+	}
+	for _, entry := range report.Unknown {
+		plan = append(plan, PlanEntry{Version: entry.Version, Status: PlanOrphan})
+	}
+	return plan, nil
+}
+
+// PrintPlan 将Plan以对齐的表格输出到w, 过长的描述会被截断
+func (x *XorMigrate) PrintPlan(w io.Writer) error {
+	plan, err := x.Plan()
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tDESCRIPTION\tSTATUS")
+	for _, entry := range plan {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", entry.Version, truncate(entry.Description, planDescriptionWidth), entry.Status)
+	}
+	return tw.Flush()
+}
+
+// truncate 将s截断为最多width个字符, 截断时以"..."结尾
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width-3]) + "..."
+}
+
+// TableStats 迁移表的统计信息
+type TableStats struct {
+	// TotalRows 迁移表中的记录数, 包括已回滚的和内部使用的记录
+	TotalRows int64
+	// RolledBackRows 已回滚的记录数
+	RolledBackRows int64
+	// OldestAppliedAt 最早运行迁移的时间, 旧版本没有记录时间的迁移不参与统计
+	OldestAppliedAt time.Time
+	// NewestAppliedAt 最近运行迁移的时间
+	NewestAppliedAt time.Time
+	// CurrentVersion 最近运行且没有回滚的迁移
+	CurrentVersion string
+}
+
+// TableStats 一次查询返回迁移表的统计信息, 不会修改数据库, 迁移表不存在时返回零值
+func (x *XorMigrate) TableStats() (TableStats, error) {
+	var stats TableStats
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return stats, err
+	}
+	var rows []struct {
+		Version    string    `xorm:"'version'"`
+		IsRollback int       `xorm:"'is_rollback'"`
+		MigratedAt time.Time `xorm:"'migrated_at'"`
+	}
+	err = x.db.
+		Table(x.options.TableName).
+		Select(fmt.Sprintf("%s AS version, %s AS is_rollback, migrated_at", x.db.Quote(x.options.VersionColumnName), x.db.Quote(x.options.RollbackColumnName))).
+		Asc(x.recordOrder()...).
+		Find(&rows)
+	if err != nil {
+		return stats, err
+	}
+	for _, row := range rows {
+		stats.TotalRows++
+		if row.IsRollback != 0 {
+			stats.RolledBackRows++
+			continue
+		}
+		if isInternalVersion(row.Version) {
+			continue
+		}
+		stats.CurrentVersion = row.Version
+		if row.MigratedAt.IsZero() {
+			continue
+		}
+		if stats.OldestAppliedAt.IsZero() || row.MigratedAt.Before(stats.OldestAppliedAt) {
+			stats.OldestAppliedAt = row.MigratedAt
+		}
+		if row.MigratedAt.After(stats.NewestAppliedAt) {
+			stats.NewestAppliedAt = row.MigratedAt
+		}
+	}
+	return stats, nil
+}
+
+// AppliedMigrations 按运行顺序返回已运行且未回滚的迁移version, 包括代码中没有定义的迁移
+// 迁移表不存在时返回空切片
+func (x *XorMigrate) AppliedMigrations() ([]string, error) {
+	versions, err := x.appliedVersions()
+	if err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		versions = []string{}
+	}
+	return versions, nil
+}
+
+// SchemaAt 返回迁移version运行后记录的表结构指纹, 见Options.SnapshotSchema
+func (x *XorMigrate) SchemaAt(version string) (string, error) {
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Cols("schema_fingerprint").
+		Where(fmt.Sprintf("%s = ? AND %s = 0", x.options.VersionColumnName, x.options.RollbackColumnName), version).
+		QueryString()
+	if err != nil {
+		return "", err
+	}
+	if len(rows) == 0 || rows[0]["schema_fingerprint"] == "" {
+		return "", fmt.Errorf("%w: %s", ErrNoSchemaSnapshot, version)
+	}
+	return rows[0]["schema_fingerprint"], nil
+}
+
+// Progress 返回代码中定义的迁移有多少个已经运行(且没有回滚)以及迁移总数, 用于健康检查等只需要比例的场景
+// 迁移表不存在时applied为0
+func (x *XorMigrate) Progress() (applied int, total int, err error) {
+	total = len(x.migrations)
+	if total == 0 {
+		return 0, 0, nil
+	}
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return 0, total, err
+	}
+	versions := make([]string, 0, total)
+	for _, migration := range x.migrations {
+		versions = append(versions, migration.Version)
+	}
+	count, err := x.db.
+		Table(x.options.TableName).
+		Where(fmt.Sprintf("%s = 0", x.options.RollbackColumnName)).
+		In(x.options.VersionColumnName, versions).
+		Count()
+	if err != nil {
+		return 0, total, err
+	}
+	return int(count), total, nil
+}
+
+// appliedVersions 按运行顺序返回数据库中已运行且未回滚的迁移, 不包括初始化和加锁等内部记录
+// 迁移表不存在时返回空
+func (x *XorMigrate) appliedVersions() ([]string, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return nil, err
+	}
+	return x.queryAppliedVersions()
+}
+
+// queryAppliedVersions 同appliedVersions, 调用方需要确认迁移表已经存在
+func (x *XorMigrate) queryAppliedVersions() ([]string, error) {
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Cols(x.options.VersionColumnName).
+		Where(fmt.Sprintf("%s = 0", x.options.RollbackColumnName)).
+		Asc(x.recordOrder()...).
+		QueryString()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]string, 0, len(rows))
+	for _, row := range rows {
+		version := row[x.options.VersionColumnName]
+		if isInternalVersion(version) {
+			continue
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+// storedRecord 迁移表中一个version的记录
+type storedRecord struct {
+	Version      string    `xorm:"'version'"`
+	IsRollback   int       `xorm:"'is_rollback'"`
+	Description  string    `xorm:"'description'"`
+	MigratedAt   time.Time `xorm:"'migrated_at'"`
+	RolledBackAt time.Time `xorm:"'rolled_back_at'"`
+}
+
+// storedRecords 返回每个version在迁移表中的记录, 有未回滚的记录时使用该记录, 否则使用最近一次回滚的记录
+// 迁移表不存在时返回nil
+func (x *XorMigrate) storedRecords() (map[string]storedRecord, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return nil, err
+	}
+	var rows []storedRecord
+	err = x.db.
+		Table(x.options.TableName).
+		Select(fmt.Sprintf(
+			"%s AS version, %s AS is_rollback, description, migrated_at, rolled_back_at",
+			x.db.Quote(x.options.VersionColumnName),
+			x.db.Quote(x.options.RollbackColumnName),
+		)).
+		Asc(x.recordOrder()...).
+		Find(&rows)
+	if err != nil {
+		return nil, err
+	}
+	records := make(map[string]storedRecord, len(rows))
+	for _, row := range rows {
+		if isInternalVersion(row.Version) {
+			continue
+		}
+		if current, ok := records[row.Version]; ok && current.IsRollback == 0 && row.IsRollback != 0 {
+			continue
+		}
+		records[row.Version] = row
+	}
+	return records, nil
+}
+
+// skippedMigrations 返回已运行但实际被跳过的迁移及其原因
+func (x *XorMigrate) skippedMigrations() (map[string]string, error) {
+	exist, err := x.migrationTableExists()
+	if err != nil || !exist {
+		return nil, err
+	}
+	rows, err := x.db.
+		Table(x.options.TableName).
+		Cols(x.options.VersionColumnName, "skip_reason").
+		Where(fmt.Sprintf("%s = 0 AND skipped = 1", x.options.RollbackColumnName)).
+		QueryString()
+	if err != nil {
+		return nil, err
+	}
+	skipped := make(map[string]string, len(rows))
+	for _, row := range rows {
+		skipped[row[x.options.VersionColumnName]] = row["skip_reason"]
+	}
+	return skipped, nil
+}
+
+// isInternalVersion 迁移表中由xormigrate自己使用的记录
+func isInternalVersion(version string) bool {
+	return version == initSchemaMigrationVersion ||
+		version == lockMigrationVersion ||
+		strings.HasPrefix(version, initSchemaProgressPrefix) ||
+		strings.HasPrefix(version, claimMigrationPrefix)
+}
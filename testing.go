@@ -0,0 +1,18 @@
+package migrate
+
+import (
+	"github.com/go-xorm/xorm"
+)
+
+// NewTestMigrator 创建一个使用内存SQLite数据库和默认配置的XorMigrate, 方便编写测试
+// 调用方需要自行导入SQLite驱动, 例如 import _ "github.com/mattn/go-sqlite3"
+func NewTestMigrator(migrations []*Migration) (*XorMigrate, *xorm.Engine, error) {
+	engine, err := xorm.NewEngine("sqlite3", ":memory:")
+	if err != nil {
+		return nil, nil, err
+	}
+	// 内存数据库的每个连接都是独立的库, 限制为单连接保证所有会话使用同一个库
+	engine.SetMaxOpenConns(1)
+	options := *DefaultOptions
+	return New(engine, &options, migrations), engine, nil
+}
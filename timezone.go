@@ -0,0 +1,96 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"sync"
+	
+	"github.com/go-xorm/xorm"
+	"xorm.io/core"
+)
+
+// initDriver 包装数据库驱动, 每个新连接在使用前先执行query
+// 用于让一个连接池中的所有连接都带有相同的会话设置
+type initDriver struct {
+	driver.Driver
+	query string
+}
+
+// Open 打开连接并执行query
+func (d initDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := execConn(conn, d.query); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// execConn 在驱动连接上执行没有参数的语句
+func execConn(conn driver.Conn, query string) error {
+	if execer, ok := conn.(driver.ExecerContext); ok {
+		_, err := execer.ExecContext(context.Background(), query, nil)
+		if err != driver.ErrSkip {
+			return err
+		}
+	}
+	stmt, err := conn.Prepare(query)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(nil)
+	return err
+}
+
+var (
+	initDriversMu sync.Mutex
+	// 已注册的包装驱动, database/sql的驱动注册后无法注销, 相同的驱动和语句只注册一次
+	initDrivers = make(map[string]struct{})
+)
+
+// registerInitDriver 为engine使用的驱动注册执行query的包装驱动, 返回注册的驱动名
+func registerInitDriver(engine *xorm.Engine, query string) (string, error) {
+	initDriversMu.Lock()
+	defer initDriversMu.Unlock()
+	
+	name := fmt.Sprintf("xormigrate:%s:%s", engine.DriverName(), query)
+	if _, ok := initDrivers[name]; ok {
+		return name, nil
+	}
+	coreDriver := core.QueryDriver(engine.DriverName())
+	if coreDriver == nil {
+		return "", fmt.Errorf("xormigrate: Unsupported driver name: %s", engine.DriverName())
+	}
+	sql.Register(name, initDriver{Driver: engine.DB().Driver(), query: query})
+	core.RegisterDriver(name, coreDriver)
+	initDrivers[name] = struct{}{}
+	return name, nil
+}
+
+// newSessionEngine 使用engine的数据源创建一个新的引擎, 它的每个连接都先执行query
+// 新引擎有自己的连接池, 会话设置不会影响engine的连接, 使用后需要关闭
+func newSessionEngine(engine *xorm.Engine, query string) (*xorm.Engine, error) {
+	name, err := registerInitDriver(engine, query)
+	if err != nil {
+		return nil, err
+	}
+	session, err := xorm.NewEngine(name, engine.DataSourceName())
+	if err != nil {
+		return nil, err
+	}
+	session.SetLogger(engine.Logger())
+	session.SetTableMapper(engine.GetTableMapper())
+	session.SetColumnMapper(engine.GetColumnMapper())
+	session.SetTZLocation(engine.GetTZLocation())
+	session.SetTZDatabase(engine.GetTZDatabase())
+	if schema := engine.Dialect().URI().Schema; schema != "" {
+		session.SetSchema(schema)
+	}
+	return session, nil
+}
@@ -0,0 +1,198 @@
+package migrate
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VersionGenerator 生成新迁移的version, 通过Options.VersionGenerator选择
+// 生成的version按字符串排序时与生成顺序一致
+type VersionGenerator interface {
+	NextVersion(x *XorMigrate) (string, error)
+}
+
+// TimestampVersionGenerator 根据当前时间生成version
+type TimestampVersionGenerator struct {
+	// Layout 时间格式, 为空时同GenVersion精确到微秒, 与GenVersion生成的version可以混用
+	Layout string
+}
+
+// NextVersion 返回当前时间
+func (g TimestampVersionGenerator) NextVersion(*XorMigrate) (string, error) {
+	if g.Layout == "" {
+		return GenVersion(), nil
+	}
+	return time.Now().Format(g.Layout), nil
+}
+
+// SequentialVersionGenerator 读取代码和迁移表中最大的数字version并加1, 例如 0001、0002
+// version可以带后缀, 例如 0002_person 视为 2, 分隔符见Options.SuffixSeparator
+type SequentialVersionGenerator struct {
+	// Width 补零后的宽度, 默认4
+	Width int
+}
+
+// NextVersion 返回最大version加1
+func (g SequentialVersionGenerator) NextVersion(x *XorMigrate) (string, error) {
+	versions := make([]string, 0, len(x.migrations))
+	for _, migration := range x.migrations {
+		versions = append(versions, migration.Version)
+	}
+	exist, err := x.migrationTableExists()
+	if err != nil {
+		return "", err
+	}
+	if exist {
+		rows, err := x.db.Table(x.options.TableName).Cols(x.options.VersionColumnName).QueryString()
+		if err != nil {
+			return "", err
+		}
+		for _, row := range rows {
+			versions = append(versions, row[x.options.VersionColumnName])
+		}
+	}
+	
+	var max int64
+	for _, version := range versions {
+		if i := strings.Index(version, x.options.SuffixSeparator); i >= 0 {
+			version = version[:i]
+		}
+		n, err := strconv.ParseInt(version, 10, 64)
+		if err != nil {
+			continue
+		}
+		if n > max {
+			max = n
+		}
+	}
+	width := g.Width
+	if width == 0 {
+		width = 4
+	}
+	return fmt.Sprintf("%0*d", width, max+1), nil
+}
+
+// ULIDVersionGenerator 生成ULID, 同一毫秒内生成的ULID也保持递增
+type ULIDVersionGenerator struct {
+	mu       sync.Mutex
+	lastTime uint64
+	last     [16]byte
+}
+
+// Crockford base32
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NextVersion 返回新的ULID
+func (g *ULIDVersionGenerator) NextVersion(*XorMigrate) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	
+	var id [16]byte
+	ms := uint64(time.Now().UnixMilli())
+	if ms <= g.lastTime {
+		// 同一毫秒(或时钟回拨)时在上一个ULID的随机部分上加1
+		id = g.last
+		for i := len(id) - 1; i >= 6; i-- {
+			id[i]++
+			if id[i] != 0 {
+				break
+			}
+		}
+	} else {
+		for i := 0; i < 6; i++ {
+			id[i] = byte(ms >> (40 - 8*i))
+		}
+		if _, err := rand.Read(id[6:]); err != nil {
+			return "", err
+		}
+		g.lastTime = ms
+	}
+	g.last = id
+	return encodeULID(id), nil
+}
+
+// encodeULID 把128位按5位一组编码为26个字符, 最高位补两个0
+func encodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+	for i := range out {
+		var v byte
+		for b := 0; b < 5; b++ {
+			bit := i*5 + b - 2
+			v <<= 1
+			if bit >= 0 && id[bit/8]&(0x80>>(bit%8)) != 0 {
+				v |= 1
+			}
+		}
+		out[i] = ulidAlphabet[v]
+	}
+	return string(out)
+}
+
+// NextVersion 使用Options.VersionGenerator生成新迁移的version, 默认为时间戳
+func (x *XorMigrate) NextVersion() (string, error) {
+	generator := x.options.VersionGenerator
+	if generator == nil {
+		generator = TimestampVersionGenerator{}
+	}
+	return generator.NextVersion(x)
+}
+
+// versionLess 返回version a是否排在b之前, 比较方式同sortLess
+func (x *XorMigrate) versionLess(a, b string) bool {
+	return sortLess(x.options)(a, b)
+}
+
+// sortLess 返回比较version的函数, 使用Options.VersionLess, 为nil时同SQL文件排序
+func sortLess(options *Options) func(a, b string) bool {
+	if options.VersionLess != nil {
+		return options.VersionLess
+	}
+	return func(a, b string) bool {
+		return compareVersions(a, b, options.SuffixSeparator) < 0
+	}
+}
+
+// compareVersions 比较两个version, 先比较separator之前的时间戳部分, 相同时再比较之后的后缀(通常是表名)
+// 两个时间戳都是数字时按数值比较, 否则按字符串比较
+func compareVersions(a, b, separator string) int {
+	aStamp, aSuffix := splitVersion(a, separator)
+	bStamp, bSuffix := splitVersion(b, separator)
+	if aStamp != bStamp {
+		if isDigits(aStamp) && isDigits(bStamp) {
+			aStamp = strings.TrimLeft(aStamp, "0")
+			bStamp = strings.TrimLeft(bStamp, "0")
+			if len(aStamp) != len(bStamp) {
+				if len(aStamp) < len(bStamp) {
+					return -1
+				}
+				return 1
+			}
+		}
+		return strings.Compare(aStamp, bStamp)
+	}
+	return strings.Compare(aSuffix, bSuffix)
+}
+
+// splitVersion 在第一个separator处拆分version, 没有separator时后缀为空
+func splitVersion(version, separator string) (stamp, suffix string) {
+	if separator == "" {
+		return version, ""
+	}
+	if i := strings.Index(version, separator); i >= 0 {
+		return version[:i], version[i+len(separator):]
+	}
+	return version, ""
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
@@ -0,0 +1,193 @@
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTimestampVersionGenerator(t *testing.T) {
+	migrator := New(newTestEngine(t), &Options{}, nil)
+	first, err := migrator.NextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := migrator.NextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != len(GenVersion()) || second <= first {
+		t.Fatalf("unexpected versions: %s, %s", first, second)
+	}
+	
+	// 与GenVersion生成的version混用时仍按生成顺序排序
+	var generated []string
+	for i := 0; i < 3; i++ {
+		version, err := migrator.NextVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		generated = append(generated, version, GenVersion())
+	}
+	sorted := append([]string(nil), generated...)
+	less := sortLess(migrator.options)
+	sort.Slice(sorted, func(i, j int) bool {
+		return less(sorted[i], sorted[j])
+	})
+	if fmt.Sprint(sorted) != fmt.Sprint(generated) {
+		t.Fatalf("expected generation order, got %v", sorted)
+	}
+	
+	minutes, err := New(newTestEngine(t), &Options{VersionGenerator: TimestampVersionGenerator{Layout: "200601021504"}}, nil).NextVersion()
+	if err != nil || len(minutes) != len("202307241038") {
+		t.Fatalf("unexpected version for a custom layout: %s, %v", minutes, err)
+	}
+}
+
+func TestSequentialVersionGenerator(t *testing.T) {
+	engine := newTestEngine(t)
+	options := &Options{VersionGenerator: SequentialVersionGenerator{}}
+	version, err := New(engine, options, nil).NextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "0001" {
+		t.Fatalf("expected 0001, got %s", version)
+	}
+	
+	// 迁移表中有代码中不存在的更大的version
+	migrator := New(engine, options, []*Migration{tableMigration("0001_person", "person"), tableMigration("0007", "pet")})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	migrator = New(engine, options, []*Migration{tableMigration("0001_person", "person"), tableMigration("0002", "toy")})
+	version, err = migrator.NextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "0008" {
+		t.Fatalf("expected 0008, got %s", version)
+	}
+	
+	// 使用自定义的后缀分隔符
+	options = &Options{VersionGenerator: SequentialVersionGenerator{}, SuffixSeparator: "-"}
+	migrator = New(newTestEngine(t), options, []*Migration{tableMigration("0003-person", "person"), tableMigration("0004-pet", "pet")})
+	version, err = migrator.NextVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "0005" {
+		t.Fatalf("expected 0005 with separator -, got %s", version)
+	}
+}
+
+func TestULIDVersionGenerator(t *testing.T) {
+	migrator := New(newTestEngine(t), &Options{VersionGenerator: &ULIDVersionGenerator{}}, nil)
+	versions := make([]string, 1000)
+	for i := range versions {
+		version, err := migrator.NextVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(version) != 26 {
+			t.Fatalf("unexpected ULID: %s", version)
+		}
+		if i > 0 && version <= versions[i-1] {
+			t.Fatalf("ULIDs are not increasing: %s <= %s", version, versions[i-1])
+		}
+		versions[i] = version
+	}
+	if !sort.StringsAreSorted(versions) {
+		t.Fatal("expected ULIDs to be sortable")
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b      string
+		separator string
+		expected  int
+	}{
+		{"202307241038_person", "202307241038_pet", "_", -1},
+		{"202307241038_pet", "202307241038_person", "_", 1},
+		{"202307241038_person", "202307241038_person", "_", 0},
+		// 先比较时间戳, 字符串比较时 "10_a" < "9_b"
+		{"9_b", "10_a", "_", -1},
+		{"202307241038", "202307241038_person", "_", -1},
+		// 后缀中的分隔符不影响时间戳
+		{"202307241038-user_role", "202307241038-user", "-", 1},
+		{"202307241039-a", "202307241038-z", "-", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b, tt.separator); got != tt.expected {
+			t.Errorf("compareVersions(%q, %q, %q) = %d, expected %d", tt.a, tt.b, tt.separator, got, tt.expected)
+		}
+	}
+}
+
+func TestGenVersion(t *testing.T) {
+	versions := make([]string, 1000)
+	for i := range versions {
+		versions[i] = GenVersion()
+	}
+	seen := make(map[string]struct{}, len(versions))
+	for i, version := range versions {
+		if len(version) != len("20230724103859123456") {
+			t.Fatalf("unexpected version: %s", version)
+		}
+		if _, ok := seen[version]; ok {
+			t.Fatalf("duplicated version: %s", version)
+		}
+		seen[version] = struct{}{}
+		if i > 0 && version <= versions[i-1] {
+			t.Fatalf("versions out of order: %s, %s", versions[i-1], version)
+		}
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	semverLess := func(a, b string) bool {
+		pa, pb := strings.Split(a, "."), strings.Split(b, ".")
+		for i := 0; i < len(pa) && i < len(pb); i++ {
+			na, _ := strconv.Atoi(pa[i])
+			nb, _ := strconv.Atoi(pb[i])
+			if na != nb {
+				return na < nb
+			}
+		}
+		return len(pa) < len(pb)
+	}
+	engine := newTestEngine(t)
+	options := &Options{
+		AutoSort:      true,
+		ValidateOrder: true,
+		RollbackFloor: "1.2.10",
+		VersionLess:   semverLess,
+	}
+	migrator := New(engine, options, []*Migration{
+		tableMigration("1.10.0", "toy"),
+		tableMigration("1.2.10", "pet"),
+		tableMigration("1.2.9", "person"),
+	})
+	if err := migrator.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	applied, err := migrator.AppliedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(applied) != "[1.2.9 1.2.10 1.10.0]" {
+		t.Fatalf("unexpected applied order: %v", applied)
+	}
+	
+	// 按字符串比较时1.10.0小于1.2.10, 会被RollbackFloor拒绝
+	if err := migrator.RollbackLast(); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrator.RollbackLast(); !errors.Is(err, ErrRollbackFloorReached) {
+		t.Fatalf("expected ErrRollbackFloorReached, got %v", err)
+	}
+}